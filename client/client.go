@@ -3,10 +3,10 @@ package client
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"go-rpc/codec"
+	"go-rpc/logger"
 	"go-rpc/server"
 	"io"
 	"log"
@@ -23,7 +23,10 @@ type Call struct {
 	Args          any
 	Reply         any
 	Error         error
-	Done          chan *Call // 表示调用是否结束
+	Metadata      codec.Metadata // 随请求发送的元数据
+	Done          chan *Call     // 表示调用是否结束
+	deadline      time.Time      // ctx的截止时间，发送时换算成剩余时间传递给服务端
+	start         time.Time      // 发起调用的时间，用于统计延迟
 }
 
 // 将call实例传输到done通道
@@ -32,21 +35,30 @@ func (call *Call) done() {
 }
 
 type Client struct {
-	c        codec.Codec
-	option   *server.Option
-	sending  sync.Mutex // 保证请求有序发送
-	header   codec.Header
-	mutex    sync.Mutex // 用来存储未处理完的请求
-	seq      uint64
-	pending  map[uint64]*Call
-	closing  bool // 客户端是否主动关闭
-	shutdown bool // 服务端是否主动关闭，表示有错误发生
+	c            codec.Codec
+	option       *server.Option
+	sending      sync.Mutex // 保证请求有序发送
+	header       codec.Header
+	mutex        sync.Mutex // 用来存储未处理完的请求
+	seq          uint64
+	pending      map[uint64]*Call
+	closing      bool           // 客户端是否主动关闭
+	shutdown     bool           // 服务端是否主动关闭，表示有错误发生
+	draining     bool           // 服务端通知即将关闭，不再发送新的请求，等待已发出的请求完成
+	features     server.Feature // 握手时与服务端协商的特性
+	interceptors []Interceptor  // Sync调用经过的拦截器
+	metrics      *clientMetrics // 为nil时不记录指标
+	logger       logger.Logger  // 日志，默认不输出
+	remoteAddr   string         // 服务端地址
 }
 
 var _ io.Closer = (*Client)(nil)
 
 var ErrShutDown = errors.New("connection is shutdown")
 
+// ErrDraining 服务端即将关闭，请求没有发送，可以换一个服务实例重试
+var ErrDraining = errors.New("rpc client: server is draining")
+
 type clientResult struct {
 	client *Client
 	err    error
@@ -64,11 +76,40 @@ func (client *Client) Close() error {
 	return client.c.Close()
 }
 
+// CodecType 返回与服务端协商后使用的codec
+func (client *Client) CodecType() codec.Type {
+	return client.option.CodecType
+}
+
 // IsAvailable 判断客户端是否可用
 func (client *Client) IsAvailable() bool {
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
-	return !client.shutdown && !client.closing
+	return !client.shutdown && !client.closing && !client.draining
+}
+
+// 是否收到了服务端的drain通知
+func (client *Client) isDraining() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.draining
+}
+
+// 收到服务端的drain通知，不再接收新的请求
+func (client *Client) drain() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.draining = true
+}
+
+// 正在drain并且已发出的请求都已完成时主动关闭连接
+func (client *Client) closeIfDrained() {
+	client.mutex.Lock()
+	drained := client.draining && len(client.pending) == 0
+	client.mutex.Unlock()
+	if drained {
+		_ = client.Close()
+	}
 }
 
 // 注册任务
@@ -79,10 +120,14 @@ func (client *Client) registryCall(call *Call) (uint64, error) {
 	if client.closing || client.shutdown {
 		return 0, ErrShutDown
 	}
+	if client.draining {
+		return 0, ErrDraining
+	}
 
 	call.Seq = client.seq
 	client.pending[call.Seq] = call // 注册请求
 	client.seq++
+	client.metrics.start(call.ServiceMethod)
 	return call.Seq, nil
 }
 
@@ -92,9 +137,24 @@ func (client *Client) removeCall(seq uint64) *Call {
 	defer client.mutex.Unlock()
 	call := client.pending[seq]
 	delete(client.pending, seq) // 调用map删除
+	if call != nil {
+		client.metrics.finish(call.ServiceMethod)
+	}
 	return call
 }
 
+// 调用结束时记录指标
+func (client *Client) observe(call *Call) {
+	latency := time.Since(call.start)
+	client.metrics.observe(call.ServiceMethod, call.Error, latency)
+	fields := []logger.Field{logger.ServiceMethod(call.ServiceMethod), logger.Seq(call.Seq),
+		logger.RemoteAddr(client.remoteAddr), logger.Latency(latency)}
+	if call.Error != nil { // 成功的调用不输出error字段
+		fields = append(fields, logger.Err(call.Error))
+	}
+	client.logger.Debug("rpc client: call done", fields...)
+}
+
 // 类似线程池关闭一样，将所有等待的任务都标记为完成并通知错误
 func (client *Client) terminateCalls(err error) {
 	client.sending.Lock()
@@ -102,8 +162,11 @@ func (client *Client) terminateCalls(err error) {
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
 	client.shutdown = true
-	for _, call := range client.pending {
+	for seq, call := range client.pending {
+		delete(client.pending, seq)
+		client.metrics.finish(call.ServiceMethod)
 		call.Error = err
+		client.observe(call)
 		call.done()
 	}
 }
@@ -112,54 +175,147 @@ func (client *Client) receive() {
 	var err error
 	for err == nil { // err不为nil就跳出循环
 		var h codec.Header
-		if err := client.c.ReadHeader(&h); err != nil {
+		if err = client.c.ReadHeader(&h); err != nil {
 			break
 		}
+		if h.Control == codec.ControlGoAway { // 服务端即将关闭，已发出的请求仍然会收到响应
+			_ = client.c.ReadBody(nil)
+			client.drain()
+			client.closeIfDrained()
+			continue
+		}
 		call := client.removeCall(h.Seq)
 		switch {
 		case call == nil:
-			// 服务端处理了请求，但是客户端这边被取消了
-			err = errors.New("client cancels request")
-		case h.Error != "":
-			// 服务端处理出错
-			err = errors.New(h.Error)
-			call.Error = err
+			// 服务端处理了请求，但是客户端这边被取消了，丢弃迟到的响应
+			_ = client.c.ReadBody(nil)
+		case h.Error != "" || h.Code != codec.CodeOK:
+			// 服务端处理出错，只影响当前请求，丢弃body帧后继续读取
+			call.Error = headerError(&h)
+			_ = client.c.ReadBody(nil)
+			client.observe(call)
 			call.done()
 		default:
-			err = client.c.ReadBody(call.Reply) // 将输出写入到reply中
-			if err != nil {
-				call.Error = fmt.Errorf("reading body" + err.Error())
+			// body解析失败只影响当前请求，连接异常会在下一次ReadHeader时暴露
+			if err := client.c.ReadBody(call.Reply); err != nil { // 将输出写入到reply中
+				call.Error = fmt.Errorf("reading body: %w", err)
 			}
+			client.observe(call)
 			call.done()
 		}
+		client.closeIfDrained()
 	}
 	// 执行到此说明发生错误，停止客户端
 	client.terminateCalls(err)
+	client.metrics.connClosed()
+	if client.isDraining() { // 已经从LoadBalanceClient中移除，需要自行关闭
+		_ = client.Close()
+	}
 }
 
 func NewClient(conn net.Conn, opt *server.Option) (*Client, error) {
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
+	if codec.NewCodecFuncMap[opt.CodecType] == nil {
 		err := fmt.Errorf("unsupported codec type: %s", opt.CodecType)
-		log.Println("rpc client, codec error: ", err)
+		optionLogger(opt).Warn("rpc client: codec error", logger.RemoteAddr(conn.RemoteAddr().String()), logger.Err(err))
 		return nil, err
 	}
-	// 预先发送option
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
-		log.Println("rpc client option error: ", err)
+	o := *opt // 协商可能修改codec，不能影响调用方传入的option
+	o.Logger = optionLogger(opt)
+	remoteAddr := conn.RemoteAddr().String()
+	c := codec.NewCodecFuncMap[o.CodecType](conn) // 创建codec不会读写连接，握手之前即可判断是否支持压缩
+	ack, err := handshake(conn, c, &o)
+	if err == nil && ack.Status == server.AckUnsupported {
+		// 服务端不支持请求的codec，从服务端支持的列表中选择一个重新握手
+		if typ, ok := negotiateCodec(ack.Codecs); ok {
+			o.Logger.Info("rpc client: codec not supported by server, fall back", logger.RemoteAddr(remoteAddr),
+				logger.F("codec", o.CodecType), logger.F("fallback", typ))
+			o.CodecType = typ
+			c = codec.NewCodecFuncMap[typ](conn)
+			ack, err = handshake(conn, c, &o)
+		}
+	}
+	if err != nil {
+		o.Logger.Warn("rpc client: handshake error", logger.RemoteAddr(remoteAddr), logger.Err(err))
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), opt), nil
+	if ack.Status == server.AckBusy {
+		_ = conn.Close()
+		return nil, fmt.Errorf("rpc client: handshake rejected: %w", server.ErrServerBusy)
+	}
+	if ack.Status != server.AckOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("rpc client: handshake rejected: %s", ack.Message)
+	}
+	if ack.Compress != opt.Compress {
+		o.Logger.Warn("rpc client: compression not supported by codec or server, fall back to no compression", logger.RemoteAddr(remoteAddr),
+			logger.F("codec", o.CodecType), logger.F("compress", opt.Compress))
+	}
+	o.Compress = ack.Compress // 以服务端确认的压缩方式为准，无法解压时不能使用该连接
+	if compress := server.SetCompressor(c, &o); compress != ack.Compress {
+		_ = conn.Close()
+		return nil, fmt.Errorf("rpc client: server acked unsupported compression %q", ack.Compress)
+	}
+	return newClientCodec(c, &o, ack.Features, remoteAddr), nil
 }
 
-func newClientCodec(f codec.Codec, opt *server.Option) *Client {
+// 发送握手请求，等待服务端确认。c没有实现codec.Compressible时不请求压缩，避免服务端发送无法解压的响应
+func handshake(conn net.Conn, c codec.Codec, opt *server.Option) (*server.Ack, error) {
+	hs := &server.Handshake{Version: server.ProtocolVersion, Features: server.SupportedFeatures, Option: *opt}
+	if _, ok := c.(codec.Compressible); !ok {
+		hs.Option.Compress = codec.NoCompress
+	}
+	if err := server.WriteHandshake(conn, hs); err != nil {
+		return nil, err
+	}
+	return server.ReadAck(conn)
+}
+
+// 协商codec时的优先顺序。gob每一帧使用独立的encoder，都要重新发送类型描述，
+// header和小的body比json大得多，所以优先使用json，gob只在服务端不支持json时使用
+var codecPriority = []codec.Type{codec.JsonType, codec.GobType}
+
+// 选择双方都支持的codec，优先使用codecPriority中靠前的
+func negotiateCodec(supported []codec.Type) (codec.Type, bool) {
+	set := make(map[codec.Type]bool, len(supported))
+	for _, typ := range supported {
+		if codec.NewCodecFuncMap[typ] != nil {
+			set[typ] = true
+		}
+	}
+	for _, typ := range codecPriority {
+		if set[typ] {
+			return typ, true
+		}
+	}
+	for _, typ := range supported { // 其他自定义的codec
+		if set[typ] {
+			return typ, true
+		}
+	}
+	return "", false
+}
+
+// 客户端使用的日志，option中没有设置时不输出
+func optionLogger(opt *server.Option) logger.Logger {
+	if opt == nil || opt.Logger == nil {
+		return logger.Nop()
+	}
+	return opt.Logger
+}
+
+func newClientCodec(f codec.Codec, opt *server.Option, features server.Feature, remoteAddr string) *Client {
 	c := &Client{
-		c:       f, // 客户端的解析方式
-		seq:     1, // 默认从1开始
-		option:  opt,
-		pending: make(map[uint64]*Call),
+		c:          f, // 客户端的解析方式
+		seq:        1, // 默认从1开始
+		option:     opt,
+		features:   features,
+		pending:    make(map[uint64]*Call),
+		metrics:    newClientMetrics(opt.Metrics),
+		logger:     optionLogger(opt),
+		remoteAddr: remoteAddr,
 	}
+	c.metrics.connOpened()
 	go c.receive()
 	return c
 }
@@ -217,33 +373,62 @@ func dialTimeout(newClient func(conn net.Conn, opt *server.Option) (*Client, err
 	}
 }
 
-// Sync 同步调用，等待返回
+// Use 注册拦截器，Sync和Async都会经过拦截器，按照注册的顺序由外到内执行，需要在发起调用之前调用
+func (client *Client) Use(interceptors ...Interceptor) {
+	client.interceptors = append(client.interceptors, interceptors...)
+}
+
+// Sync 同步调用，等待返回，ctx中通过codec.NewOutgoingContext附加的元数据会随请求发送
 func (client *Client) Sync(ctx context.Context, serviceMethod string, args, reply any) error {
-	call := client.Async(serviceMethod, args, reply, make(chan *Call, 1))
+	return chainInterceptors(client.interceptors, client.sync)(ctx, serviceMethod, args, reply)
+}
+
+func (client *Client) sync(ctx context.Context, serviceMethod string, args, reply any) error {
+	call := newCall(serviceMethod, args, reply, make(chan *Call, 1))
+	call.Metadata = codec.OutgoingFromContext(ctx)
+	call.deadline, _ = ctx.Deadline()
+	client.send(call)
 	select {
 	case <-ctx.Done(): // 说明是通过context取消的
-		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		err := fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+		if client.removeCall(call.Seq) != nil { // 请求仍在等待响应，通知服务端取消
+			client.cancel(call.Seq)
+			call.Error = err
+			client.observe(call)
+		}
+		return err
 	case c := <-call.Done: // 说明是client任务执行玩取消的
 		return c.Error
 	}
 }
 
-// Async 异步调用，返回call实例
+// Async 异步调用，返回call实例，注册了拦截器时在后台经过拦截器后再发送
 func (client *Client) Async(serviceMethod string, args, reply any, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10) // 带缓存的通道
 	} else if cap(done) == 0 {
 		log.Panic("rpc client done channel is unbuffered")
 	}
-	c := &Call{
+	c := newCall(serviceMethod, args, reply, done)
+	if len(client.interceptors) == 0 {
+		client.send(c)
+		return c
+	}
+	go func() {
+		c.Error = chainInterceptors(client.interceptors, client.sync)(context.Background(), serviceMethod, args, reply)
+		c.done()
+	}()
+	return c
+}
+
+func newCall(serviceMethod string, args, reply any, done chan *Call) *Call {
+	return &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
+		start:         time.Now(),
 	}
-	client.send(c)
-	return c
 }
 
 func (client *Client) send(call *Call) {
@@ -253,21 +438,47 @@ func (client *Client) send(call *Call) {
 	seq, err := client.registryCall(call) // 注册call
 	if err != nil {
 		call.Error = err
+		client.observe(call)
 		call.done()
 		return
 	}
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.Metadata = call.Metadata
+	client.header.Timeout = 0
+	if !call.deadline.IsZero() {
+		if client.header.Timeout = time.Until(call.deadline); client.header.Timeout <= 0 { // 已经超时，不需要再发送
+			client.removeCall(seq)
+			call.Error = server.ErrDeadlineExceeded
+			client.observe(call)
+			call.done()
+			return
+		}
+	}
 	if err := client.c.Write(&client.header, call.Args); err != nil { // 发送消息
 		client.removeCall(seq)
 		if call != nil {
 			call.Error = err
+			client.observe(call)
 			call.done()
 		}
 	}
 }
 
+// 发送取消控制消息，服务端不支持时忽略
+func (client *Client) cancel(seq uint64) {
+	if client.features&server.FeatureCancel == 0 {
+		return
+	}
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	h := &codec.Header{Seq: seq, Control: codec.ControlCancel}
+	if err := client.c.Write(h, nil); err != nil {
+		client.logger.Warn("rpc client: send cancel error", logger.RemoteAddr(client.remoteAddr), logger.Seq(seq), logger.Err(err))
+	}
+}
+
 func DialHTTP(network, address string, opts ...*server.Option) (*Client, error) {
 	return dialTimeout(NewHttpClient, network, address, opts...)
 }
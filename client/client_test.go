@@ -0,0 +1,468 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go-rpc/codec"
+	"go-rpc/logger"
+	"go-rpc/metrics"
+	"go-rpc/server"
+	"go-rpc/service"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSyncCancel(t *testing.T) {
+	ch := make(chan string)
+	go startServer(ch)
+	c, err := Dial("tcp", <-ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	var reply int
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Sync(ctx, "Foo.Sleep", &service.Args{Num1: 1, Num2: 1}, &reply); err == nil {
+		t.Fatal("expect Foo.Sleep canceled")
+	}
+	time.Sleep(time.Second) // 等待迟到的响应(如果有)被丢弃
+	if err := c.Sync(context.Background(), "Foo.Sum", &service.Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 || !c.IsAvailable() {
+		t.Errorf("connection should stay usable after cancel: %v", err)
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	ch := make(chan string)
+	go startServer(ch)
+	d := NewMultiServerDiscovery([]string{<-ch})
+	c := NewLoadBalanceClient(d, RoundRobinSelect, nil)
+	defer func() { _ = c.Close() }()
+
+	var calls []string
+	c.Use(func(ctx context.Context, serviceMethod string, args, reply any, invoker Invoker) error {
+		err := invoker(ctx, serviceMethod, args, reply)
+		calls = append(calls, serviceMethod)
+		return err
+	})
+	var reply int
+	if err := c.Call(context.Background(), "Foo.Sum", &service.Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("call Foo.Sum failed: %v", err)
+	}
+	if err := c.Broadcast(context.Background(), "Foo.Sum", &service.Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatalf("broadcast Foo.Sum failed: %v", err)
+	}
+	if len(calls) != 2 {
+		t.Errorf("expect interceptor called twice, got %v", calls)
+	}
+}
+
+func TestCodecFallback(t *testing.T) {
+	if typ, ok := negotiateCodec([]codec.Type{"application/unknown", codec.GobType, codec.JsonType}); !ok || typ != codec.JsonType {
+		t.Errorf("expect json preferred, got %q", typ)
+	}
+	if typ, ok := negotiateCodec([]codec.Type{"application/unknown", codec.GobType}); !ok || typ != codec.GobType {
+		t.Errorf("expect gob when json is not supported, got %q", typ)
+	}
+	if _, ok := negotiateCodec([]codec.Type{"application/unknown"}); ok {
+		t.Error("expect no common codec")
+	}
+
+	// 模拟只支持json的服务端
+	c1, c2 := net.Pipe()
+	go func() {
+		defer func() { _ = c2.Close() }()
+		for {
+			hs, err := server.ReadHandshake(c2)
+			if err != nil {
+				return
+			}
+			ack := &server.Ack{Version: server.ProtocolVersion, Status: server.AckOK, Codecs: []codec.Type{codec.JsonType}}
+			if hs.Option.CodecType != codec.JsonType {
+				ack.Status, ack.Message = server.AckUnsupported, "unsupported codec"
+			}
+			if server.WriteAck(c2, ack) != nil || ack.Status == server.AckOK {
+				return
+			}
+		}
+	}()
+	opt := *server.DefaultOption
+	c, err := NewClient(c1, &opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if c.CodecType() != codec.JsonType || opt.CodecType != server.DefaultOption.CodecType {
+		t.Errorf("expect fall back to json without changing option, got %q", c.CodecType())
+	}
+}
+
+// 没有实现codec.Compressible的codec
+type plainCodec struct {
+	codec.Codec
+}
+
+const plainType codec.Type = "application/plain"
+
+func TestCompressNotSupportedByCodec(t *testing.T) {
+	codec.NewCodecFuncMap[plainType] = func(conn io.ReadWriteCloser) codec.Codec {
+		return plainCodec{codec.NewJsonCodec(conn)}
+	}
+	defer delete(codec.NewCodecFuncMap, plainType)
+
+	// 模拟会按照握手请求压缩响应的服务端
+	c1, c2 := net.Pipe()
+	compress := make(chan codec.CompressType, 1)
+	go func() {
+		hs, err := server.ReadHandshake(c2)
+		if err != nil {
+			return
+		}
+		compress <- hs.Option.Compress
+		_ = server.WriteAck(c2, &server.Ack{Version: server.ProtocolVersion, Status: server.AckOK, Compress: hs.Option.Compress})
+	}()
+	opt := *server.DefaultOption
+	opt.CodecType, opt.Compress = plainType, codec.GzipCompress
+	c, err := NewClient(c1, &opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if got := <-compress; got != codec.NoCompress {
+		t.Errorf("expect no compression requested for a codec without Compressible, got %q", got)
+	}
+}
+
+// 并发安全的日志输出位置
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCallLog(t *testing.T) {
+	ch := make(chan string)
+	go startServer(ch)
+	var buf syncBuffer
+	opt := *server.DefaultOption
+	opt.Logger = logger.New(&buf, logger.DebugLevel)
+	c, err := Dial("tcp", <-ch, &opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	var reply int
+	if err := c.Sync(context.Background(), "Foo.Sum", &service.Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Sync(context.Background(), "Foo.Missing", &service.Args{}, &reply)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var done []string
+	for _, line := range lines {
+		if strings.Contains(line, "call done") {
+			done = append(done, line)
+		}
+	}
+	if len(done) != 2 || strings.Contains(done[0], "error=") || !strings.Contains(done[1], "error=") {
+		t.Errorf("expect error field only on the failed call, got %q", done)
+	}
+}
+
+func TestClientInterceptor(t *testing.T) {
+	ch := make(chan string)
+	go startServer(ch)
+	c, err := Dial("tcp", <-ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	var calls atomic.Int32
+	var order []string
+	c.Use(func(ctx context.Context, serviceMethod string, args, reply any, invoker Invoker) error {
+		calls.Add(1)
+		return invoker(codec.NewOutgoingContext(ctx, codec.Metadata{"token": "t"}), serviceMethod, args, reply)
+	}, func(ctx context.Context, serviceMethod string, args, reply any, invoker Invoker) error {
+		if codec.OutgoingFromContext(ctx).Get("token") == "" {
+			return errors.New("missing token")
+		}
+		order = append(order, serviceMethod)
+		return invoker(ctx, serviceMethod, args, reply)
+	})
+	var reply int
+	if err := c.Sync(context.Background(), "Foo.Sum", &service.Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("sync Foo.Sum failed: %v, %d", err, reply)
+	}
+	call := <-c.Async("Foo.Sum", &service.Args{Num1: 2, Num2: 2}, &reply, nil).Done
+	if call.Error != nil || reply != 4 {
+		t.Fatalf("async Foo.Sum failed: %v, %d", call.Error, reply)
+	}
+	if calls.Load() != 2 || len(order) != 2 {
+		t.Errorf("expect interceptors called for Sync and Async, got %d, %v", calls.Load(), order)
+	}
+}
+
+func startTestServer(t *testing.T) (*server.Server, string) {
+	var foo service.Foo
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.NewServer()
+	_ = s.Register(&foo)
+	go s.Accept(l)
+	return s, l.Addr().String()
+}
+
+func TestDrain(t *testing.T) {
+	s1, addr1 := startTestServer(t)
+	_, addr2 := startTestServer(t)
+	c := NewLoadBalanceClient(NewMultiServerDiscovery([]string{addr1, addr2}), RoundRobinSelect, nil)
+	defer func() { _ = c.Close() }()
+
+	client, _ := c.dial(addr1)
+	pending := client.Async("Foo.Sleep", &service.Args{Num1: 1, Num2: 2}, new(int), nil)
+	time.Sleep(100 * time.Millisecond)
+	go func() { _ = s1.Shutdown(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+
+	if client.IsAvailable() {
+		t.Error("client should be unavailable after go away")
+	}
+	for i := 0; i < 4; i++ {
+		var reply int
+		if err := c.Call(context.Background(), "Foo.Sum", &service.Args{Num1: i, Num2: i}, &reply); err != nil || reply != 2*i {
+			t.Errorf("call should move to other instance: %v", err)
+		}
+	}
+	if call := <-pending.Done; call.Error != nil || *call.Reply.(*int) != 2 {
+		t.Errorf("pending call should complete after drain: %v", call.Error)
+	}
+}
+
+func TestServerBusy(t *testing.T) {
+	var foo service.Foo
+	l, _ := net.Listen("tcp", ":0")
+	s := server.NewServer()
+	_ = s.Register(&foo)
+	s.SetLimits(server.Limits{MaxConns: 1, MaxConnRequests: 1, Policy: server.RejectOnLimit})
+	go s.Accept(l)
+	addr := l.Addr().String()
+	c, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if _, err := Dial("tcp", addr); !errors.Is(err, server.ErrServerBusy) {
+		t.Errorf("expect connection rejected with server busy, got %v", err)
+	}
+	pending := c.Async("Foo.Sleep", &service.Args{Num1: 1, Num2: 1}, new(int), nil)
+	time.Sleep(100 * time.Millisecond)
+	var reply int
+	if err := c.Sync(context.Background(), "Foo.Sum", &service.Args{Num1: 1, Num2: 2}, &reply); !errors.Is(err, server.ErrServerBusy) {
+		t.Errorf("expect request rejected with server busy, got %v", err)
+	}
+	if call := <-pending.Done; call.Error != nil {
+		t.Errorf("in-flight request should complete: %v", call.Error)
+	}
+}
+
+type Coded int
+
+func (c Coded) Check(args int, reply *int) error {
+	if args < 0 {
+		return codec.NewStatus(codec.CodeInvalidArgument, "negative args", "args must be >= 0")
+	}
+	return errors.New("plain error")
+}
+
+func TestErrorCode(t *testing.T) {
+	s, addr := startTestServer(t)
+	var coded Coded
+	_ = s.Register(&coded)
+	c, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	var reply int
+	var e *Error
+	err = c.Sync(context.Background(), "Coded.Check", -1, &reply)
+	if !errors.As(err, &e) || e.Code != codec.CodeInvalidArgument || e.Message != "negative args" ||
+		len(e.Details) != 1 || e.Details[0] != "args must be >= 0" {
+		t.Errorf("expect coded error survive round trip, got %#v", err)
+	}
+	if err = c.Sync(context.Background(), "Coded.Check", 1, &reply); Code(err) != codec.CodeUnknown || err.Error() != "plain error" {
+		t.Errorf("expect unknown code for plain error, got %v", err)
+	}
+	if err = c.Sync(context.Background(), "Foo.Missing", 1, &reply); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expect not found, got %v", err)
+	}
+	if err = c.Sync(context.Background(), "Foo.Sum", &service.Args{Num1: 1, Num2: 2}, &reply); Code(err) != codec.CodeOK || reply != 3 {
+		t.Errorf("expect ok after errors, got %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	_, addr := startTestServer(t)
+	r := metrics.NewRegistry()
+	opt := *server.DefaultOption
+	opt.Metrics = r
+	c, err := Dial("tcp", addr, &opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply int
+	_ = c.Sync(context.Background(), "Foo.Sum", &service.Args{Num1: 1, Num2: 2}, &reply)
+	_ = c.Sync(context.Background(), "Foo.Missing", 1, &reply)
+	pending := c.Async("Foo.Sleep", &service.Args{Num1: 1, Num2: 1}, new(int), nil)
+	if v := r.Gauge("go_rpc_client_pending_calls", "", "method").With("Foo.Sleep").Value(); v != 1 {
+		t.Errorf("expect 1 pending call, got %v", v)
+	}
+	<-pending.Done
+	if v := r.Counter("go_rpc_client_requests_total", "", "method").With("Foo.Sum").Value(); v != 1 {
+		t.Errorf("expect 1 Foo.Sum call, got %v", v)
+	}
+	if v := r.Counter("go_rpc_client_errors_total", "", "method", "code").With("Foo.Missing", "NotFound").Value(); v != 1 {
+		t.Errorf("expect 1 not found error, got %v", v)
+	}
+	if v := r.Gauge("go_rpc_client_pending_calls", "", "method").With("Foo.Sleep").Value(); v != 0 {
+		t.Errorf("expect no pending call, got %v", v)
+	}
+	if v := r.Gauge("go_rpc_client_connections", "").With().Value(); v != 1 {
+		t.Errorf("expect 1 open connection, got %v", v)
+	}
+	_ = c.Close()
+	time.Sleep(50 * time.Millisecond)
+	if v := r.Gauge("go_rpc_client_connections", "").With().Value(); v != 0 {
+		t.Errorf("expect connection closed, got %v", v)
+	}
+}
+
+// Flaky fail不为0时返回对应错误码的错误
+type Flaky struct {
+	fail  codec.Code
+	calls int32
+}
+
+func (f *Flaky) Get(args int, reply *int) error {
+	atomic.AddInt32(&f.calls, 1)
+	if f.fail != codec.CodeOK {
+		return codec.NewStatus(f.fail, "flaky")
+	}
+	*reply = args
+	return nil
+}
+
+func startFlakyServer(t *testing.T, fail codec.Code) (*Flaky, string) {
+	s, addr := startTestServer(t)
+	f := &Flaky{fail: fail}
+	_ = s.Register(f)
+	return f, addr
+}
+
+func TestRetry(t *testing.T) {
+	busy, busyAddr := startFlakyServer(t, codec.CodeServerBusy)
+	_, okAddr := startFlakyServer(t, codec.CodeOK)
+	c := NewLoadBalanceClient(NewMultiServerDiscovery([]string{busyAddr, okAddr}), RoundRobinSelect, nil)
+	defer func() { _ = c.Close() }()
+
+	var reply int
+	failures := 0
+	for i := 0; i < 4; i++ {
+		if err := c.Call(context.Background(), "Flaky.Get", 1, &reply); err != nil {
+			failures++
+		}
+	}
+	if failures != 2 {
+		t.Errorf("expect half of the calls fail without retry policy, got %d", failures)
+	}
+
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: 0.5, Methods: []string{"Flaky"}})
+	atomic.StoreInt32(&busy.calls, 0)
+	for i := 0; i < 4; i++ {
+		if err := c.Call(context.Background(), "Flaky.Get", i, &reply); err != nil || reply != i {
+			t.Errorf("call should be retried on another instance: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&busy.calls); n > 4 {
+		t.Errorf("expect busy instance tried at most once per call, got %d", n)
+	}
+}
+
+func TestRetryRandomSelect(t *testing.T) {
+	busy, busyAddr := startFlakyServer(t, codec.CodeServerBusy)
+	_, okAddr := startFlakyServer(t, codec.CodeOK)
+	c := NewLoadBalanceClient(NewMultiServerDiscovery([]string{busyAddr, okAddr}), RandomSelect, nil)
+	defer func() { _ = c.Close() }()
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, Methods: []string{"Flaky.Get"}})
+
+	// 随机选择时重试也不会再次选中失败过的实例
+	var reply int
+	for i := 0; i < 30; i++ {
+		before := atomic.LoadInt32(&busy.calls)
+		if err := c.Call(context.Background(), "Flaky.Get", i, &reply); err != nil || reply != i {
+			t.Fatalf("call %d should be retried on the healthy instance: %v", i, err)
+		}
+		if n := atomic.LoadInt32(&busy.calls) - before; n > 1 {
+			t.Fatalf("call %d picked the failed instance %d times", i, n)
+		}
+	}
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	invalid, invalidAddr := startFlakyServer(t, codec.CodeInvalidArgument)
+	c := NewLoadBalanceClient(NewMultiServerDiscovery([]string{invalidAddr}), RoundRobinSelect, nil)
+	defer func() { _ = c.Close() }()
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Methods: []string{"Flaky.Get"}})
+
+	var reply int
+	if err := c.Call(context.Background(), "Flaky.Get", 1, &reply); Code(err) != codec.CodeInvalidArgument {
+		t.Errorf("expect invalid argument, got %v", err)
+	}
+	if n := atomic.LoadInt32(&invalid.calls); n != 1 {
+		t.Errorf("non-retryable error should not be retried, got %d calls", n)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	busy, busyAddr := startFlakyServer(t, codec.CodeServerBusy)
+	c := NewLoadBalanceClient(NewMultiServerDiscovery([]string{busyAddr}), RoundRobinSelect, nil)
+	defer func() { _ = c.Close() }()
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 5, InitialBackoff: 40 * time.Millisecond, Methods: []string{"Flaky.Get"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var reply int
+	if err := c.Call(ctx, "Flaky.Get", 1, &reply); !errors.Is(err, ErrServerBusy) {
+		t.Errorf("expect last error returned, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("retry should stop before deadline, took %s", elapsed)
+	}
+	if n := atomic.LoadInt32(&busy.calls); n != 2 {
+		t.Errorf("expect 2 attempts within deadline, got %d", n)
+	}
+}
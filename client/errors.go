@@ -0,0 +1,35 @@
+package client
+
+import (
+	"go-rpc/codec"
+	"go-rpc/server"
+)
+
+// Error 服务端返回的带错误码的错误，可以通过errors.As获取错误码和详情
+type Error = codec.Status
+
+// 常见的服务端错误，错误码相同即匹配，调用方可以通过errors.Is判断
+var (
+	ErrDeadlineExceeded       = server.ErrDeadlineExceeded
+	ErrServerShutdown         = server.ErrServerShutdown
+	ErrServerBusy             = server.ErrServerBusy
+	ErrRateLimited            = server.ErrRateLimited
+	ErrNotFound         error = codec.NewStatus(codec.CodeNotFound, "rpc client: service or method not found")
+)
+
+// Code 返回err的错误码，nil返回CodeOK，ctx超时或者取消返回对应的错误码，其他非服务端错误返回CodeUnknown
+func Code(err error) codec.Code {
+	if err == nil {
+		return codec.CodeOK
+	}
+	return codec.StatusFromError(err).Code
+}
+
+// 根据响应header还原服务端返回的错误
+func headerError(h *codec.Header) error {
+	code := h.Code
+	if code == codec.CodeOK { // 只设置了错误信息，没有错误码
+		code = codec.CodeUnknown
+	}
+	return &Error{Code: code, Message: h.Error, Details: h.Details}
+}
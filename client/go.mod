@@ -7,6 +7,8 @@ replace (
 	go-rpc/server => ../server
 	go-rpc/service => ../service
 	go-rpc/registry => ../registry
+	go-rpc/metrics => ../metrics
+	go-rpc/logger => ../logger
 )
 
 require (
@@ -14,4 +16,6 @@ require (
 	go-rpc/server v0.0.1
 	go-rpc/service v0.0.1
 	go-rpc/registry v0.0.1
+	go-rpc/metrics v0.0.1
+	go-rpc/logger v0.0.1
 )
@@ -0,0 +1,20 @@
+package client
+
+import "context"
+
+// Invoker 真正发起调用的函数
+type Invoker func(ctx context.Context, serviceMethod string, args, reply any) error
+
+// Interceptor 客户端拦截器，调用invoker继续执行，可以在调用前后处理日志、重试、元数据等
+type Interceptor func(ctx context.Context, serviceMethod string, args, reply any, invoker Invoker) error
+
+// 从最后一个拦截器开始包装，保证第一个注册的拦截器最先执行
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply any) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
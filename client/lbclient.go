@@ -2,10 +2,12 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"go-rpc/logger"
 	"go-rpc/registry"
 	"go-rpc/server"
-	"log"
+	"math/rand"
 	"net/http"
 	"reflect"
 	"strings"
@@ -13,13 +15,17 @@ import (
 	"time"
 )
 
+const maxSelectAttempts = 3 // 实例不可用时最多重新选择的次数
+
 // LoadBalanceClient 支持负载均衡的客户端
 type LoadBalanceClient struct {
-	d       Discovery
-	mode    SelectMode
-	opt     *server.Option
-	mu      sync.Mutex
-	clients map[string]*Client
+	d            Discovery
+	mode         SelectMode
+	opt          *server.Option
+	mu           sync.Mutex
+	clients      map[string]*Client
+	interceptors []Interceptor // Call和Broadcast经过的拦截器
+	retry        *retryPolicy  // Call的重试策略，为nil时不重试
 }
 
 func NewLoadBalanceClient(d Discovery, mode SelectMode, opt *server.Option) *LoadBalanceClient {
@@ -48,7 +54,9 @@ func (c *LoadBalanceClient) dial(addr string) (*Client, error) {
 
 	client, ok := c.clients[addr]
 	if ok && !client.IsAvailable() { // 如果client存在但是已经close了就移除
-		_ = client.Close()
+		if !client.isDraining() { // 正在drain的client等待已发出的请求完成后自行关闭
+			_ = client.Close()
+		}
 		delete(c.clients, addr)
 		client = nil
 	}
@@ -72,16 +80,83 @@ func (c *LoadBalanceClient) call(addr string, ctx context.Context, serviceMethod
 	return client.Sync(ctx, serviceMethod, args, reply)
 }
 
+// Use 注册拦截器，按照注册的顺序由外到内执行，需要在发起调用之前调用
+func (c *LoadBalanceClient) Use(interceptors ...Interceptor) {
+	c.interceptors = append(c.interceptors, interceptors...)
+}
+
 // Call 根据负载均衡模式获取一个地址
 func (c *LoadBalanceClient) Call(ctx context.Context, serviceMethod string, args, reply any) error {
+	return chainInterceptors(c.interceptors, c.invoke)(ctx, serviceMethod, args, reply)
+}
+
+// 按照重试策略调用，每次重试优先选择之前没有失败过的实例
+func (c *LoadBalanceClient) invoke(ctx context.Context, serviceMethod string, args, reply any) error {
+	attempts := c.retry.attempts(serviceMethod)
+	failed := make(map[string]bool)
+	for attempt := 1; ; attempt++ {
+		addr, err := c.invokeOnce(ctx, serviceMethod, args, reply, failed)
+		if err == nil || addr == "" || attempt >= attempts || ctx.Err() != nil || !c.retry.retryable(err) {
+			return err
+		}
+		failed[addr] = true
+		backoff := c.retry.backoff(attempt)
+		optionLogger(c.opt).Debug("rpc client: retry call", logger.ServiceMethod(serviceMethod), logger.RemoteAddr(addr),
+			logger.F("attempt", attempt), logger.F("backoff", backoff), logger.Err(err))
+		if !waitRetry(ctx, backoff) {
+			return err
+		}
+	}
+}
+
+// 选择实例并调用一次，选择的实例无法连接或者正在drain时请求并没有发出，换一个实例重新选择。
+// 返回最后选择的实例地址，没有可选的实例时为空
+func (c *LoadBalanceClient) invokeOnce(ctx context.Context, serviceMethod string, args, reply any, failed map[string]bool) (addr string, err error) {
+	for i := 0; i < maxSelectAttempts; i++ {
+		if addr, err = c.selectAddr(failed); err != nil {
+			return "", err
+		}
+		var client *Client
+		if client, err = c.dial(addr); err != nil {
+			failed[addr] = true
+			continue
+		}
+		if err = client.Sync(ctx, serviceMethod, args, reply); !errors.Is(err, ErrDraining) {
+			return addr, err
+		}
+	}
+	return addr, err
+}
+
+// 按照负载均衡模式选择实例，选中失败过的实例时从其余没有失败过的实例中随机选择，
+// 所有实例都失败过时仍然按照负载均衡模式选择，没有任何实例时返回错误
+func (c *LoadBalanceClient) selectAddr(failed map[string]bool) (string, error) {
 	addr, err := c.d.Get(c.mode)
+	if err != nil || !failed[addr] {
+		return addr, err
+	}
+	servers, err := c.d.GetAll()
 	if err != nil {
-		return err
+		return "", err
 	}
-	return c.call(addr, ctx, serviceMethod, args, reply)
+	candidates := servers[:0]
+	for _, s := range servers {
+		if !failed[s] {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return addr, nil
+	}
+	return candidates[rand.Intn(len(candidates))], nil
 }
 
+// Broadcast 调用所有服务实例，拦截器对整个广播只执行一次
 func (c *LoadBalanceClient) Broadcast(ctx context.Context, serviceMethod string, arg, reply any) error {
+	return chainInterceptors(c.interceptors, c.broadcast)(ctx, serviceMethod, arg, reply)
+}
+
+func (c *LoadBalanceClient) broadcast(ctx context.Context, serviceMethod string, arg, reply any) error {
 	servers, err := c.d.GetAll()
 	if err != nil {
 		return err
@@ -122,6 +197,7 @@ type RegistryDiscovery struct {
 	registry              string        // 注册中心的地址
 	timeout               time.Duration // 注册中心的服务列表的过期时间
 	lastUpdate            time.Time     // 从注册中心更新服务列表的时间
+	logger                logger.Logger // 日志，默认不输出
 }
 
 const (
@@ -136,10 +212,19 @@ func NewRegistryDiscovery(addr string, timeout time.Duration) *RegistryDiscovery
 		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
 		registry:             addr,
 		timeout:              timeout,
+		logger:               logger.Nop(),
 	}
 	return r
 }
 
+// SetLogger 设置刷新服务列表时的日志，为nil时不输出
+func (r *RegistryDiscovery) SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.Nop()
+	}
+	r.logger = l
+}
+
 func (r *RegistryDiscovery) Update(servers []string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -157,10 +242,10 @@ func (r *RegistryDiscovery) Refresh() error {
 		return nil
 	}
 
-	log.Printf("rpc registry: refresh servers from registry: %s\n", r.registry)
+	r.logger.Debug("rpc registry: refresh servers from registry", logger.F("registry", r.registry))
 	resp, err := http.Get(r.registry)
 	if err != nil {
-		log.Println("rpc registry refresh err:", err)
+		r.logger.Warn("rpc registry: refresh error", logger.F("registry", r.registry), logger.Err(err))
 		return err
 	}
 	servers := strings.Split(resp.Header.Get(registry.DefaultHeader), ",")
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"go-rpc/metrics"
+	"time"
+)
+
+// 客户端的指标，为nil时不记录
+type clientMetrics struct {
+	requests   *metrics.CounterVec   // 按方法统计的请求数
+	errors     *metrics.CounterVec   // 按方法和错误码统计的错误数
+	latency    *metrics.HistogramVec // 按方法统计的调用延迟
+	pending    *metrics.GaugeVec     // 按方法统计的等待响应的请求数
+	conns      metrics.Gauge         // 当前的连接数
+	connsTotal metrics.Counter       // 累计建立的连接数
+}
+
+// 同一个Registry中的客户端共享同名指标
+func newClientMetrics(r *metrics.Registry) *clientMetrics {
+	if r == nil {
+		return nil
+	}
+	return &clientMetrics{
+		requests:   r.Counter("go_rpc_client_requests_total", "Total number of calls made by the client.", "method"),
+		errors:     r.Counter("go_rpc_client_errors_total", "Total number of calls that returned an error, by code.", "method", "code"),
+		latency:    r.Histogram("go_rpc_client_request_duration_seconds", "Call latency in seconds.", nil, "method"),
+		pending:    r.Gauge("go_rpc_client_pending_calls", "Number of calls waiting for a response.", "method"),
+		conns:      r.Gauge("go_rpc_client_connections", "Number of open connections.").With(),
+		connsTotal: r.Counter("go_rpc_client_connections_total", "Total number of established connections.").With(),
+	}
+}
+
+func (m *clientMetrics) connOpened() {
+	if m != nil {
+		m.conns.Inc()
+		m.connsTotal.Inc()
+	}
+}
+
+func (m *clientMetrics) connClosed() {
+	if m != nil {
+		m.conns.Dec()
+	}
+}
+
+func (m *clientMetrics) start(method string) {
+	if m != nil {
+		m.pending.With(method).Inc()
+	}
+}
+
+func (m *clientMetrics) finish(method string) {
+	if m != nil {
+		m.pending.With(method).Dec()
+	}
+}
+
+// 记录调用的结果，err为nil表示成功
+func (m *clientMetrics) observe(method string, err error, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.With(method).Inc()
+	if err != nil {
+		m.errors.With(method, Code(err).String()).Inc()
+	}
+	m.latency.With(method).Observe(d.Seconds())
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"go-rpc/codec"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// DefaultRetryableCodes 默认可以重试的错误码，服务端没有处理请求或者暂时无法处理
+var DefaultRetryableCodes = []codec.Code{codec.CodeUnavailable, codec.CodeServerBusy, codec.CodeRateLimited}
+
+// RetryPolicy LoadBalanceClient.Call的重试策略，只有Methods中声明的幂等方法才会重试
+type RetryPolicy struct {
+	MaxAttempts    int           // 包括第一次调用在内的最大调用次数，小于等于1时不重试
+	InitialBackoff time.Duration // 第一次重试前的等待时间，为0时使用50ms
+	MaxBackoff     time.Duration // 等待时间的上限，为0时使用1s
+	Multiplier     float64       // 每次重试等待时间的增长倍数，小于1时使用2
+	Jitter         float64       // 等待时间随机浮动的比例，取值[0,1]，避免多个客户端同时重试
+	RetryableCodes []codec.Code  // 可以重试的错误码，为空时使用DefaultRetryableCodes，连接断开等传输错误总是可以重试
+	Methods        []string      // 允许重试的方法，Service.Method或者Service表示该服务的所有方法
+}
+
+// 规范化后的重试策略
+type retryPolicy struct {
+	RetryPolicy
+	codes   map[codec.Code]bool
+	methods map[string]bool
+}
+
+// SetRetryPolicy 设置Call的重试策略，重试时优先选择没有失败过的实例，需要在发起调用之前调用
+func (c *LoadBalanceClient) SetRetryPolicy(p RetryPolicy) {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 50 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Second
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	} else if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	if len(p.RetryableCodes) == 0 {
+		p.RetryableCodes = DefaultRetryableCodes
+	}
+	r := &retryPolicy{RetryPolicy: p, codes: make(map[codec.Code]bool), methods: make(map[string]bool)}
+	for _, code := range p.RetryableCodes {
+		r.codes[code] = true
+	}
+	for _, method := range p.Methods {
+		r.methods[method] = true
+	}
+	c.retry = r
+}
+
+// 方法允许的最大调用次数
+func (p *retryPolicy) attempts(serviceMethod string) int {
+	if p == nil || p.MaxAttempts <= 1 {
+		return 1
+	}
+	service := serviceMethod
+	if i := strings.LastIndex(serviceMethod, "."); i >= 0 {
+		service = serviceMethod[:i]
+	}
+	if p.methods[serviceMethod] || p.methods[service] {
+		return p.MaxAttempts
+	}
+	return 1
+}
+
+// 服务端返回的错误按错误码判断，序列化错误重试也不会成功，其余的传输错误都可以重试
+func (p *retryPolicy) retryable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return p.codes[e.Code]
+	}
+	return !errors.Is(err, codec.ErrEncodeBody) && !errors.Is(err, codec.ErrDecodeBody)
+}
+
+// 第attempt次重试前的等待时间，指数增长并随机浮动
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt && d < float64(p.MaxBackoff); i++ {
+		d *= p.Multiplier
+	}
+	if d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	d += d * p.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(d)
+}
+
+// 等待backoff后重试，ctx在此之前结束或者剩余时间不够时放弃
+func waitRetry(ctx context.Context, backoff time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+		return false
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
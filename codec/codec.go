@@ -2,15 +2,30 @@ package codec
 
 import (
 	"io"
+	"time"
 )
 
 // Header 定义请求与响应的Header结构体
 type Header struct {
-	ServiceMethod string // 服务名和方法名
-	Seq           uint64 // 请求的序号，用来区别请求
-	Error         string // 错误信息
+	ServiceMethod string        // 服务名和方法名
+	Seq           uint64        // 请求的序号，用来区别请求
+	Error         string        // 错误信息
+	Code          Code          // 错误码，成功时为CodeOK
+	Details       []string      // 可选的错误详情
+	Metadata      Metadata      // 请求的元数据
+	Control       Control       // 控制消息类型，普通请求和响应为ControlNone
+	Timeout       time.Duration // 客户端ctx剩余的超时时间，0表示不限制
 }
 
+// Control 控制消息类型，控制消息的body为空
+type Control uint8
+
+const (
+	ControlNone   Control = iota // 普通请求和响应
+	ControlCancel                // 客户端取消Seq对应的请求
+	ControlGoAway                // 服务端即将关闭，客户端不要再发送新的请求
+)
+
 // Codec 定义接口，规范client和server请求和响应的格式
 type Codec interface {
 	io.Closer                 // 定义关闭方法
@@ -19,16 +34,25 @@ type Codec interface {
 	Write(*Header, any) error // 输出返回
 }
 
+// Sizer 可以获取最近一次读写的body帧大小的codec，用于统计请求和响应的大小
+type Sizer interface {
+	ReadSize() int
+	WriteSize() int
+}
+
 type Type string
 type NewCodecFunc func(io.ReadWriteCloser) Codec // 用来创建codec的类型，传入conn就能创建codec
 
 const (
 	JsonType Type = "application/json" // 使用json作为序列化方式
+	GobType  Type = "application/gob"  // 使用gob作为序列化方式
 )
 
+// NewCodecFuncMap 已注册的codec，自定义的codec需要实现Compressible才能使用握手协商的压缩，否则退化为不压缩
 var NewCodecFuncMap map[Type]NewCodecFunc
 
 func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc)
 	NewCodecFuncMap[JsonType] = NewJsonCodec // 基于json构造函数
+	NewCodecFuncMap[GobType] = NewGobCodec   // 基于gob构造函数
 }
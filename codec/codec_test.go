@@ -0,0 +1,118 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+type args struct {
+	Num1, Num2 int
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for typ, f := range NewCodecFuncMap {
+		c1, c2 := net.Pipe()
+		client, server := f(c1), f(c2)
+		go func() {
+			_ = client.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1, Metadata: Metadata{"trace-id": "1"}}, args{Num1: 1, Num2: 2})
+		}()
+		var h Header
+		var body args
+		if err := server.ReadHeader(&h); err != nil || h.ServiceMethod != "Foo.Sum" || h.Seq != 1 || h.Metadata.Get("trace-id") != "1" {
+			t.Errorf("%s: read header failed: %v, %+v", typ, err, h)
+		}
+		if err := server.ReadBody(&body); err != nil || body.Num1 != 1 || body.Num2 != 2 {
+			t.Errorf("%s: read body failed: %v, %+v", typ, err, body)
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func TestReadBodyErrorKeepsConnection(t *testing.T) {
+	for typ, f := range NewCodecFuncMap {
+		c1, c2 := net.Pipe()
+		client, server := f(c1), f(c2)
+		go func() {
+			_ = client.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, args{Num1: 1, Num2: 2})
+			_ = client.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, args{Num1: 3, Num2: 4})
+		}()
+		var h Header
+		var bad string
+		var body args
+		_ = server.ReadHeader(&h)
+		if err := server.ReadBody(&bad); !errors.Is(err, ErrDecodeBody) {
+			t.Errorf("%s: expect decode body error, got %v", typ, err)
+		}
+		if err := server.ReadHeader(&h); err != nil || h.Seq != 2 {
+			t.Errorf("%s: read next header failed: %v, %+v", typ, err, h)
+		}
+		if err := server.ReadBody(&body); err != nil || body.Num1 != 3 {
+			t.Errorf("%s: read next body failed: %v, %+v", typ, err, body)
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func TestWriteBodyTooLargeKeepsConnection(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, server := NewCodecFuncMap[GobType](c1), NewCodecFuncMap[GobType](c2)
+	defer func() { _ = client.Close() }()
+	defer func() { _ = server.Close() }()
+	// 超过MaxFrameSize的body在写出任何数据之前被拒绝，连接仍然可用
+	if err := client.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, make([]byte, MaxFrameSize)); !errors.Is(err, ErrEncodeBody) {
+		t.Fatalf("expect encode body error, got %v", err)
+	}
+	go func() {
+		_ = client.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, args{Num1: 1, Num2: 2})
+	}()
+	var h Header
+	var body args
+	if err := server.ReadHeader(&h); err != nil || h.Seq != 2 || server.ReadBody(&body) != nil || body.Num1 != 1 {
+		t.Errorf("read next request failed: %v, %+v", err, h)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for typ, compressor := range CompressorMap {
+		c1, c2 := net.Pipe()
+		client, server := NewJsonCodec(c1), NewJsonCodec(c2)
+		client.(Compressible).SetCompressor(compressor, 16)
+		server.(Compressible).SetCompressor(compressor, 16)
+		body := make([]int, 1000)
+		go func() {
+			_ = client.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, body)
+		}()
+		var h Header
+		var got []int
+		_ = server.ReadHeader(&h)
+		if err := server.ReadBody(&got); err != nil || len(got) != len(body) {
+			t.Errorf("%s: read compressed body failed: %v", typ, err)
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func TestReadFrameAllocatesIncrementally(t *testing.T) {
+	var head [FrameHeaderSize]byte
+	head[0] = byte(BodyFrame)
+	binary.BigEndian.PutUint32(head[2:], MaxFrameSize) // 声明最大长度，但只发送少量数据
+	r := io.MultiReader(bytes.NewReader(head[:]), bytes.NewReader(make([]byte, 1024)))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ReadFrame(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expect unexpected EOF, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("truncated frame should not allocate declared size, allocated %d bytes", n)
+	}
+}
@@ -0,0 +1,101 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+)
+
+// CompressType 压缩方式，握手时协商
+type CompressType string
+
+const (
+	NoCompress    CompressType = ""      // 不压缩
+	GzipCompress  CompressType = "gzip"  // gzip压缩
+	FlateCompress CompressType = "flate" // deflate压缩，没有gzip的头部开销
+
+	DefaultCompressThreshold = 1024 // 超过该长度的body才会压缩
+)
+
+// FlagCompressed 表示该帧的payload已被压缩
+const FlagCompressed FrameFlag = 1 << 0
+
+// Compressor 对帧的payload进行压缩和解压
+type Compressor interface {
+	Compress([]byte) ([]byte, error)
+	Decompress([]byte) ([]byte, error)
+}
+
+// Compressible 支持压缩body帧的codec，压缩对具体的序列化方式透明。
+// 压缩作用在已经序列化的body帧上，内置的codec通过嵌入*FrameCodec实现，没有实现该接口的codec不压缩
+type Compressible interface {
+	SetCompressor(c Compressor, threshold int)
+}
+
+var CompressorMap map[CompressType]Compressor
+
+func init() {
+	CompressorMap = make(map[CompressType]Compressor)
+	CompressorMap[GzipCompress] = &gzipCompressor{}
+	CompressorMap[FlateCompress] = &flateCompressor{}
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return readLimited(r)
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer func() {
+		_ = r.Close()
+	}()
+	return readLimited(r)
+}
+
+// 解压后的长度同样受MaxFrameSize限制，防止恶意构造的payload
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,218 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+  1. 每个Header和body都单独成帧，帧头固定长度，payload由具体codec序列化
+  2. | type(1) | flags(1) | length(4) | payload(length) |
+*/
+
+// FrameType 帧类型，用来校验读取到的是header还是body
+type FrameType uint8
+
+const (
+	HeaderFrame FrameType = iota + 1 // header帧
+	BodyFrame                        // body帧
+)
+
+// FrameFlag 帧标志位
+type FrameFlag uint8
+
+const (
+	FrameHeaderSize = 6        // 帧头长度
+	MaxFrameSize    = 64 << 20 // 单帧payload的最大长度
+	frameReadChunk  = 64 << 10 // 超过该长度的帧边读边分配内存
+)
+
+var (
+	ErrFrameTooLarge = errors.New("rpc codec: frame too large")
+	ErrEncodeBody    = errors.New("rpc codec: encode body error") // body序列化失败，此时尚未写出任何数据，连接仍然可用
+	ErrDecodeBody    = errors.New("rpc codec: decode body error") // body反序列化失败，该帧已被完整读取，连接仍然可用
+)
+
+// Frame 一个完整的帧
+type Frame struct {
+	Type    FrameType
+	Flags   FrameFlag
+	Payload []byte
+}
+
+// ReadFrame 读取一个完整的帧
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var head [FrameHeaderSize]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[2:])
+	if n > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	f := &Frame{Type: FrameType(head[0]), Flags: FrameFlag(head[1])}
+	if n <= frameReadChunk {
+		f.Payload = make([]byte, n)
+		if _, err := io.ReadFull(r, f.Payload); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	// 大帧按实际到达的数据逐步扩容，避免只收到帧头就按声明的长度分配内存
+	var buf bytes.Buffer
+	buf.Grow(frameReadChunk)
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	f.Payload = buf.Bytes()
+	return f, nil
+}
+
+// WriteFrame 输出一个完整的帧
+func WriteFrame(w io.Writer, f *Frame) error {
+	if len(f.Payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	var head [FrameHeaderSize]byte
+	head[0] = byte(f.Type)
+	head[1] = byte(f.Flags)
+	binary.BigEndian.PutUint32(head[2:], uint32(len(f.Payload)))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.Payload)
+	return err
+}
+
+// FrameCodec 基于分帧协议的codec，具体的序列化方式由marshal和unmarshal决定
+type FrameCodec struct {
+	conn       io.ReadWriteCloser        // 连接实例
+	r          *bufio.Reader             // 带缓冲的reader
+	buf        *bufio.Writer             // 防止阻塞而创建的带缓冲的writer
+	marshal    func(any) ([]byte, error) // 序列化
+	unmarshal  func([]byte, any) error   // 反序列化
+	compressor Compressor                // 协商后的压缩方式，为nil表示不压缩
+	threshold  int                       // 超过该长度的body才会压缩
+	readSize   int                       // 最近一次读取的body帧大小
+	writeSize  int                       // 最近一次写入的body帧大小
+}
+
+// NewFrameCodec FrameCodec的构造函数
+func NewFrameCodec(conn io.ReadWriteCloser, marshal func(any) ([]byte, error), unmarshal func([]byte, any) error) *FrameCodec {
+	return &FrameCodec{
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		buf:       bufio.NewWriter(conn),
+		marshal:   marshal,
+		unmarshal: unmarshal,
+	}
+}
+
+// SetCompressor 设置压缩方式，只压缩超过threshold的body帧
+func (c *FrameCodec) SetCompressor(compressor Compressor, threshold int) {
+	c.compressor = compressor
+	c.threshold = threshold
+}
+
+// 读取指定类型的帧，类型不一致说明连接已经错乱
+func (c *FrameCodec) readFrame(typ FrameType) (*Frame, error) {
+	f, err := ReadFrame(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if f.Type != typ {
+		return nil, fmt.Errorf("rpc codec: unexpected frame type %d, expect %d", f.Type, typ)
+	}
+	return f, nil
+}
+
+func (c *FrameCodec) ReadHeader(h *Header) error {
+	f, err := c.readFrame(HeaderFrame)
+	if err != nil {
+		return err
+	}
+	return c.unmarshal(f.Payload, h)
+}
+
+// ReadBody body为nil时直接丢弃该帧
+func (c *FrameCodec) ReadBody(body any) error {
+	f, err := c.readFrame(BodyFrame)
+	if err != nil {
+		return err
+	}
+	c.readSize = len(f.Payload)
+	if body == nil || len(f.Payload) == 0 {
+		return nil
+	}
+	payload := f.Payload
+	if f.Flags&FlagCompressed != 0 {
+		if c.compressor == nil {
+			return fmt.Errorf("%w: compressed frame without negotiated compressor", ErrDecodeBody)
+		}
+		if payload, err = c.compressor.Decompress(payload); err != nil {
+			return fmt.Errorf("%w: %s", ErrDecodeBody, err.Error())
+		}
+	}
+	if err := c.unmarshal(payload, body); err != nil {
+		return fmt.Errorf("%w: %s", ErrDecodeBody, err.Error())
+	}
+	return nil
+}
+
+// Write 先完成header和body的序列化再输出，序列化失败不会破坏连接
+func (c *FrameCodec) Write(h *Header, body any) (err error) {
+	header, err := c.marshal(h)
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	var flags FrameFlag
+	if body != nil {
+		if payload, err = c.marshal(body); err != nil {
+			return fmt.Errorf("%w: %s", ErrEncodeBody, err.Error())
+		}
+	}
+	if c.compressor != nil && len(payload) >= c.threshold {
+		// 压缩后没有变小就按原样发送
+		if compressed, err := c.compressor.Compress(payload); err == nil && len(compressed) < len(payload) {
+			payload, flags = compressed, FlagCompressed
+		}
+	}
+	if len(payload) > MaxFrameSize { // 写出header之前检查，避免body过大时破坏连接
+		return fmt.Errorf("%w: %s", ErrEncodeBody, ErrFrameTooLarge.Error())
+	}
+	c.writeSize = len(payload)
+	defer func() {
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err = WriteFrame(c.buf, &Frame{Type: HeaderFrame, Payload: header}); err != nil {
+		return err
+	}
+	if err = WriteFrame(c.buf, &Frame{Type: BodyFrame, Flags: flags, Payload: payload}); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+// ReadSize 最近一次ReadBody读取的body帧大小，压缩时为压缩后的大小
+func (c *FrameCodec) ReadSize() int {
+	return c.readSize
+}
+
+// WriteSize 最近一次Write写入的body帧大小，压缩时为压缩后的大小
+func (c *FrameCodec) WriteSize() int {
+	return c.writeSize
+}
+
+func (c *FrameCodec) Close() error {
+	return c.conn.Close()
+}
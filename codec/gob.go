@@ -0,0 +1,30 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+)
+
+// GobCodec 基于gob的二进制codec实现，保留int等类型信息
+type GobCodec struct {
+	*FrameCodec
+}
+
+// 每一帧使用独立的encoder，保证帧之间互不依赖
+func gobMarshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gobUnmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// NewGobCodec gobCodec的构造函数
+func NewGobCodec(conn io.ReadWriteCloser) Codec {
+	return &GobCodec{NewFrameCodec(conn, gobMarshal, gobUnmarshal)}
+}
@@ -0,0 +1,60 @@
+package codec
+
+import "context"
+
+// Metadata 随请求传递的元数据，如trace id、鉴权token、租户id等
+type Metadata map[string]string
+
+// Get 获取元数据，md为nil时返回空字符串
+func (md Metadata) Get(key string) string {
+	return md[key]
+}
+
+// Copy 返回副本，避免多个请求共享同一个map
+func (md Metadata) Copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	c := make(Metadata, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+type outgoingKey struct{}
+type incomingKey struct{}
+
+// NewOutgoingContext 客户端将元数据附加到ctx上，调用时随header发送
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext 在ctx已有元数据的基础上追加键值对
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md := OutgoingFromContext(ctx).Copy()
+	if md == nil {
+		md = make(Metadata, len(kv)/2)
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return NewOutgoingContext(ctx, md)
+}
+
+// OutgoingFromContext 获取客户端待发送的元数据
+func OutgoingFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingKey{}).(Metadata)
+	return md
+}
+
+// NewIncomingContext 服务端将请求header中的元数据附加到ctx上
+func NewIncomingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// IncomingFromContext 服务端获取请求携带的元数据
+func IncomingFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingKey{}).(Metadata)
+	return md
+}
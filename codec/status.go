@@ -0,0 +1,87 @@
+package codec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Code 错误码，随header传递
+type Code uint32
+
+const (
+	CodeOK               Code = iota // 成功
+	CodeUnknown                      // 未分类的错误，如service方法直接返回的普通error
+	CodeInvalidArgument              // 请求不合法，如ServiceMethod格式错误、body解析失败
+	CodeNotFound                     // 找不到服务或者方法
+	CodeDeadlineExceeded             // 处理超时
+	CodeCanceled                     // 请求被取消
+	CodeUnavailable                  // 服务端正在关闭
+	CodeServerBusy                   // 达到连接数或者并发请求数上限
+	CodeRateLimited                  // 超过限流速率
+	CodeInternal                     // 服务端内部错误，如方法panic、响应序列化失败
+)
+
+var codeNames = map[Code]string{
+	CodeOK:               "OK",
+	CodeUnknown:          "Unknown",
+	CodeInvalidArgument:  "InvalidArgument",
+	CodeNotFound:         "NotFound",
+	CodeDeadlineExceeded: "DeadlineExceeded",
+	CodeCanceled:         "Canceled",
+	CodeUnavailable:      "Unavailable",
+	CodeServerBusy:       "ServerBusy",
+	CodeRateLimited:      "RateLimited",
+	CodeInternal:         "Internal",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Status 带错误码的错误，service方法返回Status时错误码和详情可以原样传递给客户端
+type Status struct {
+	Code    Code     // 错误码
+	Message string   // 错误信息
+	Details []string // 可选的错误详情
+}
+
+// NewStatus Status的构造函数
+func NewStatus(code Code, message string, details ...string) *Status {
+	return &Status{Code: code, Message: message, Details: details}
+}
+
+// Errorf 格式化错误信息并构造Status
+func Errorf(code Code, format string, args ...any) *Status {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (s *Status) Error() string {
+	return s.Message
+}
+
+// Is 错误码相同即认为是同一种错误，调用方可以通过errors.Is判断
+func (s *Status) Is(target error) bool {
+	t, ok := target.(*Status)
+	return ok && t.Code == s.Code
+}
+
+// StatusFromError 将error转换为Status，nil返回nil
+func StatusFromError(err error) *Status {
+	var s *Status
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &s):
+		return s
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewStatus(CodeDeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return NewStatus(CodeCanceled, err.Error())
+	default:
+		return NewStatus(CodeUnknown, err.Error())
+	}
+}
@@ -7,6 +7,9 @@ require (
 	go-rpc/server v0.0.1
 	go-rpc/service v0.0.1
 	go-rpc/client v0.0.1
+	go-rpc/registry v0.0.1
+	go-rpc/metrics v0.0.1
+	go-rpc/logger v0.0.1
 )
 
 replace (
@@ -14,4 +17,7 @@ replace (
 	go-rpc/server => ./server
 	go-rpc/service => ./service
 	go-rpc/client => ./client
+	go-rpc/registry => ./registry
+	go-rpc/metrics => ./metrics
+	go-rpc/logger => ./logger
 )
\ No newline at end of file
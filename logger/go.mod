@@ -0,0 +1,3 @@
+module go-rpc/logger
+
+go 1.19
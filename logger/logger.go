@@ -0,0 +1,131 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Level 日志级别
+type Level int8
+
+const (
+	DebugLevel Level = iota // 调试信息，如每个请求的处理过程
+	InfoLevel               // 一般信息，如服务注册、codec协商
+	WarnLevel               // 可以恢复的异常，如握手失败、响应发送失败
+	ErrorLevel              // 需要关注的错误，如方法panic
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "DEBUG"
+	case InfoLevel:
+		return "INFO"
+	case WarnLevel:
+		return "WARN"
+	case ErrorLevel:
+		return "ERROR"
+	}
+	return "Level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Field 结构化日志的键值对
+type Field struct {
+	Key   string
+	Value any
+}
+
+// F 构造任意键值对
+func F(key string, value any) Field {
+	return Field{Key: key, Value: value}
+}
+
+// 常用字段的键
+const (
+	KeyServiceMethod = "service_method"
+	KeySeq           = "seq"
+	KeyRemoteAddr    = "remote_addr"
+	KeyLatency       = "latency"
+	KeyError         = "error"
+)
+
+// ServiceMethod 服务名和方法名
+func ServiceMethod(serviceMethod string) Field { return F(KeyServiceMethod, serviceMethod) }
+
+// Seq 请求的序号
+func Seq(seq uint64) Field { return F(KeySeq, seq) }
+
+// RemoteAddr 对端地址
+func RemoteAddr(addr string) Field { return F(KeyRemoteAddr, addr) }
+
+// Latency 耗时
+func Latency(d time.Duration) Field { return F(KeyLatency, d) }
+
+// Err 错误信息
+func Err(err error) Field { return F(KeyError, err) }
+
+// Logger 带级别和结构化字段的日志接口，实现需要并发安全
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...Field) {}
+func (nopLogger) Info(string, ...Field)  {}
+func (nopLogger) Warn(string, ...Field)  {}
+func (nopLogger) Error(string, ...Field) {}
+
+// Nop 丢弃所有日志，是Server和Client的默认值
+func Nop() Logger {
+	return nopLogger{}
+}
+
+// 以文本形式输出的Logger
+type textLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+// New 将不低于level的日志以 `时间 级别 信息 key=value ...` 的文本形式输出到w
+func New(w io.Writer, level Level) Logger {
+	return &textLogger{l: log.New(w, "", log.LstdFlags), level: level}
+}
+
+func (t *textLogger) Debug(msg string, fields ...Field) { t.output(DebugLevel, msg, fields) }
+func (t *textLogger) Info(msg string, fields ...Field)  { t.output(InfoLevel, msg, fields) }
+func (t *textLogger) Warn(msg string, fields ...Field)  { t.output(WarnLevel, msg, fields) }
+func (t *textLogger) Error(msg string, fields ...Field) { t.output(ErrorLevel, msg, fields) }
+
+func (t *textLogger) output(level Level, msg string, fields []Field) {
+	if level < t.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for _, f := range fields {
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		b.WriteString(formatValue(f.Value))
+	}
+	_ = t.l.Output(3, b.String())
+}
+
+// 包含空白或者引号的值加上引号，保证一行日志可以按空格切分
+func formatValue(v any) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
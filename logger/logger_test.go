@@ -0,0 +1,25 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, InfoLevel)
+	l.Debug("dropped", Seq(1))
+	l.Warn("rpc server: write response error", ServiceMethod("Foo.Sum"), Seq(2), Latency(time.Millisecond), Err(errors.New("broken pipe")))
+
+	out := buf.String()
+	if strings.Contains(out, "dropped") {
+		t.Errorf("debug log should be filtered: %s", out)
+	}
+	want := `WARN rpc server: write response error service_method=Foo.Sum seq=2 latency=1ms error="broken pipe"`
+	if !strings.HasSuffix(strings.TrimSpace(out), want) {
+		t.Errorf("unexpected output: %s", out)
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"go-rpc/client"
+	"go-rpc/logger"
+	"go-rpc/metrics"
 	"go-rpc/server"
 	"go-rpc/service"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 )
@@ -23,12 +26,20 @@ func startServer(protocol string, addr chan string) {
 	var foo service.Foo
 	listen, _ := net.Listen("tcp", ":0")
 	s := server.DefaultServer
+	l := logger.New(os.Stderr, logger.InfoLevel)
+	s.SetLogger(l)
 	_ = s.Register(&foo)
+	metrics.DefaultRegistry.SetLogger(l)
+	s.SetMetrics(metrics.DefaultRegistry)
 	log.Println("rpc server start at: ", listen.Addr().String())
 	addr <- listen.Addr().String()
 	switch protocol {
 	case "http":
-		_ = http.Serve(listen, s)
+		mux := http.NewServeMux()
+		mux.Handle(server.DefaultRpcPath, s)
+		mux.Handle(server.DefaultDebugPath, s.DebugHandler()) // 调试页面
+		mux.Handle("/metrics", metrics.DefaultRegistry.Handler())
+		_ = http.Serve(listen, mux)
 	default:
 		s.Accept(listen)
 	}
@@ -0,0 +1,7 @@
+module go-rpc/metrics
+
+go 1.19
+
+require go-rpc/logger v0.0.1
+
+replace go-rpc/logger => ../logger
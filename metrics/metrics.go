@@ -0,0 +1,315 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"go-rpc/logger"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets 默认的延迟直方图分桶，单位秒
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry 默认的指标集合
+var DefaultRegistry = NewRegistry()
+
+// 指标的类型
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Registry 指标的集合，同名指标只会创建一次，以Prometheus文本格式输出
+type Registry struct {
+	mu     sync.Mutex
+	vecs   map[string]*vec
+	logger logger.Logger // Handler输出失败时的日志，默认不输出
+}
+
+// NewRegistry Registry的构造函数
+func NewRegistry() *Registry {
+	return &Registry{vecs: make(map[string]*vec), logger: logger.Nop()}
+}
+
+// SetLogger 设置Handler输出失败时的日志，为nil时不输出
+func (r *Registry) SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.Nop()
+	}
+	r.logger = l
+}
+
+// Counter 获取或者创建只增不减的计数器
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.vec(name, help, typeCounter, nil, labels)}
+}
+
+// Gauge 获取或者创建可增可减的仪表盘
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.vec(name, help, typeGauge, nil, labels)}
+}
+
+// Histogram 获取或者创建直方图，buckets为空时使用DefBuckets。
+// buckets会被复制并排序，之后修改传入的切片不影响直方图，+Inf总是会输出不需要传入，包含重复值或者NaN说明使用方式有误
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	if n := len(buckets); n > 0 && math.IsInf(buckets[n-1], 1) { // +Inf分桶总是会输出
+		buckets = buckets[:n-1]
+	}
+	for i, b := range buckets {
+		if math.IsNaN(b) || i > 0 && b == buckets[i-1] {
+			panic(fmt.Sprintf("metrics: invalid buckets for %s: %v", name, buckets))
+		}
+	}
+	return &HistogramVec{r.vec(name, help, typeHistogram, buckets, labels)}
+}
+
+// 同名指标已存在时直接返回，类型或者标签不一致说明使用方式有误
+func (r *Registry) vec(name, help, typ string, buckets []float64, labels []string) *vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.vecs[name]; ok {
+		if v.typ != typ || strings.Join(v.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s already registered as %s%v", name, v.typ, v.labels))
+		}
+		return v
+	}
+	v := &vec{name: name, help: help, typ: typ, buckets: buckets, labels: labels, series: make(map[string]*series)}
+	r.vecs[name] = v
+	return v
+}
+
+// Write 按名称顺序输出所有指标
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	vecs := make([]*vec, 0, len(r.vecs))
+	for _, v := range r.vecs {
+		vecs = append(vecs, v)
+	}
+	r.mu.Unlock()
+	sort.Slice(vecs, func(i, j int) bool { return vecs[i].name < vecs[j].name })
+	bw := bufio.NewWriter(w)
+	for _, v := range vecs {
+		v.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler 返回输出Prometheus文本格式的http.Handler
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.Write(w); err != nil {
+			r.logger.Warn("metrics: write error", logger.Err(err))
+		}
+	})
+}
+
+// 同名指标的所有标签组合
+type vec struct {
+	name    string
+	help    string
+	typ     string
+	buckets []float64
+	labels  []string
+	mu      sync.RWMutex
+	series  map[string]*series // 标签值 -> 时间序列
+}
+
+// 一组标签值对应的时间序列
+type series struct {
+	values []string
+	bits   uint64 // counter和gauge的值，float64的二进制表示
+	mu     sync.Mutex
+	counts []uint64 // 直方图每个分桶的计数(非累计)，最后一个是+Inf
+	sum    float64
+	count  uint64
+}
+
+func (v *vec) with(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expect %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok = v.series[key]; !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if v.typ == typeHistogram {
+			s.counts = make([]uint64, len(v.buckets)+1)
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (s *series) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&s.bits)
+		if atomic.CompareAndSwapUint64(&s.bits, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (s *series) value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.bits))
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mu.RLock()
+	list := make([]*series, 0, len(v.series))
+	for _, s := range v.series {
+		list = append(list, s)
+	}
+	v.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].values, "\xff") < strings.Join(list[j].values, "\xff")
+	})
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.typ)
+	for _, s := range list {
+		if v.typ != typeHistogram {
+			_, _ = fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(s.values, ""), formatFloat(s.value()))
+			continue
+		}
+		s.mu.Lock()
+		var cumulative uint64
+		for i, upper := range v.buckets {
+			cumulative += s.counts[i]
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(s.values, formatFloat(upper)), cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(s.values, "+Inf"), s.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labelString(s.values, ""), formatFloat(s.sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labelString(s.values, ""), s.count)
+		s.mu.Unlock()
+	}
+}
+
+// 拼接标签，le不为空时追加直方图的分桶标签
+func (v *vec) labelString(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(values)+1)
+	for i, value := range values {
+		pairs = append(pairs, v.labels[i]+`="`+escapeLabel(value)+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// CounterVec 按标签区分的计数器
+type CounterVec struct{ v *vec }
+
+// Counter 一组标签值对应的计数器
+type Counter struct{ s *series }
+
+// With 按照注册时标签的顺序传入标签值
+func (c *CounterVec) With(values ...string) Counter { return Counter{c.v.with(values)} }
+
+// Inc 加1
+func (c Counter) Inc() { c.s.add(1) }
+
+// Add 增加delta，delta不能为负数
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metrics: counter cannot decrease: %v", delta))
+	}
+	c.s.add(delta)
+}
+
+// Value 当前的值
+func (c Counter) Value() float64 { return c.s.value() }
+
+// GaugeVec 按标签区分的仪表盘
+type GaugeVec struct{ v *vec }
+
+// Gauge 一组标签值对应的仪表盘
+type Gauge struct{ s *series }
+
+// With 按照注册时标签的顺序传入标签值
+func (g *GaugeVec) With(values ...string) Gauge { return Gauge{g.v.with(values)} }
+
+// Inc 加1
+func (g Gauge) Inc() { g.s.add(1) }
+
+// Dec 减1
+func (g Gauge) Dec() { g.s.add(-1) }
+
+// Add 增加delta，可以为负数
+func (g Gauge) Add(delta float64) { g.s.add(delta) }
+
+// Set 设置为指定的值
+func (g Gauge) Set(value float64) { atomic.StoreUint64(&g.s.bits, math.Float64bits(value)) }
+
+// Value 当前的值
+func (g Gauge) Value() float64 { return g.s.value() }
+
+// HistogramVec 按标签区分的直方图
+type HistogramVec struct{ v *vec }
+
+// Histogram 一组标签值对应的直方图
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// With 按照注册时标签的顺序传入标签值
+func (h *HistogramVec) With(values ...string) Histogram {
+	return Histogram{s: h.v.with(values), buckets: h.v.buckets}
+}
+
+// Observe 记录一次观测值，延迟以秒为单位
+func (h Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value) // 第一个大于等于value的分桶
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	h.s.counts[i]++
+	h.s.sum += value
+	h.s.count++
+}
+
+// Count 观测的次数
+func (h Histogram) Count() uint64 {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return h.s.count
+}
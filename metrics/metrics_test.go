@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("requests_total", "Total requests.", "method").With("Foo.Sum").Add(2)
+	if c := r.Counter("requests_total", "Total requests.", "method").With("Foo.Sum"); c.Value() != 2 {
+		t.Errorf("expect same counter returned, got %v", c.Value())
+	}
+	g := r.Gauge("connections", "Open connections.").With()
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h := r.Histogram("duration_seconds", "Latency.", []float64{0.1, 1}, "method").With(`a"b`)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# HELP connections Open connections.
+# TYPE connections gauge
+connections 1
+# HELP duration_seconds Latency.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{method="a\"b",le="0.1"} 1
+duration_seconds_bucket{method="a\"b",le="1"} 2
+duration_seconds_bucket{method="a\"b",le="+Inf"} 3
+duration_seconds_sum{method="a\"b"} 5.55
+duration_seconds_count{method="a\"b"} 3
+# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{method="Foo.Sum"} 2
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("unexpected output:\n%s", got)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected content type %s", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	r := NewRegistry()
+	buckets := []float64{1, 0.1}
+	h := r.Histogram("duration_seconds", "Latency.", buckets).With()
+	buckets[0] = 0.01 // 修改传入的切片不影响直方图
+	h.Observe(0.05)
+	h.Observe(0.5)
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`duration_seconds_bucket{le="0.1"} 1`, `duration_seconds_bucket{le="1"} 2`} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("expect %q in output:\n%s", line, w.Body.String())
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expect panic on duplicate buckets")
+		}
+	}()
+	r.Histogram("size_bytes", "Size.", []float64{1, 1})
+}
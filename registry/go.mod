@@ -1,3 +1,7 @@
 module registry
 
 go 1.19
+
+require go-rpc/logger v0.0.1
+
+replace go-rpc/logger => ../logger
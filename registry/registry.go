@@ -1,7 +1,7 @@
 package registry
 
 import (
-	"log"
+	"go-rpc/logger"
 	"net/http"
 	"sort"
 	"strings"
@@ -67,26 +67,34 @@ func (r *Registry) aliveServer() []string {
 
 // Heartbeat 发送心跳并更新注册时间
 func Heartbeat(registry, addr string, duration time.Duration) {
+	HeartbeatWithLogger(registry, addr, duration, nil)
+}
+
+// HeartbeatWithLogger 同Heartbeat，发送心跳失败时输出到l，为nil时不输出
+func HeartbeatWithLogger(registry, addr string, duration time.Duration, l logger.Logger) {
 	if duration == 0 {
 		duration = DefaultTimeout - time.Duration(1)*time.Minute // 保证足够的时间发送心跳
 	}
+	if l == nil {
+		l = logger.Nop()
+	}
 	var err error
-	err = sendHeartbeat(registry, addr) // 预先发送一次心跳
+	err = sendHeartbeat(registry, addr, l) // 预先发送一次心跳
 	go func() {
 		t := time.NewTicker(duration)
 		for err == nil {
 			<-t.C
-			err = sendHeartbeat(registry, addr)
+			err = sendHeartbeat(registry, addr, l)
 		}
 	}()
 }
 
-func sendHeartbeat(registry, addr string) error {
+func sendHeartbeat(registry, addr string, l logger.Logger) error {
 	c := &http.Client{}
 	req, _ := http.NewRequest("POST", registry, nil)
 	req.Header.Set(DefaultHeader, addr)
 	if _, err := c.Do(req); err != nil {
-		log.Println("rpc server: heartbeat error:", err)
+		l.Warn("rpc server: heartbeat error", logger.F("registry", registry), logger.F("addr", addr), logger.Err(err))
 		return err
 	}
 	return nil
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLog 访问日志的配置，每次调用输出一行JSON
+type AccessLog struct {
+	Writer       io.Writer // 输出位置，需要自行关闭
+	SampleRate   float64   // 成功请求的采样比例，0或者大于等于1时全部记录，出错的请求总是记录
+	LogArgs      bool      // 是否记录请求参数，调用了方法但没有被采样的出错请求不记录参数
+	RedactFields []string  // 记录请求参数时替换为"***"的字段名，按JSON中的键匹配，大小写不敏感
+}
+
+// 一次调用的访问记录
+type accessRecord struct {
+	Time          time.Time       `json:"time"`
+	RemoteAddr    string          `json:"remote_addr,omitempty"`
+	ServiceMethod string          `json:"service_method"`
+	Seq           uint64          `json:"seq"`
+	LatencyMs     float64         `json:"latency_ms"`
+	RequestSize   int             `json:"request_size"`
+	ResponseSize  int             `json:"response_size"`
+	Code          string          `json:"code"`
+	Error         string          `json:"error,omitempty"`
+	Args          json.RawMessage `json:"args,omitempty"`
+}
+
+const redacted = "***"
+
+type accessLogger struct {
+	opt    AccessLog
+	redact map[string]bool // 小写的字段名
+	mu     sync.Mutex      // 保证每行完整输出
+}
+
+// SetAccessLog 将每次调用的时间、客户端地址、方法、序号、耗时、请求和响应大小以及错误以JSON行写入opt.Writer，
+// 需要在开始处理请求之前调用，opt.Writer为nil时关闭访问日志
+func (server *Server) SetAccessLog(opt AccessLog) {
+	if opt.Writer == nil {
+		server.accessLog = nil
+		return
+	}
+	l := &accessLogger{opt: opt, redact: make(map[string]bool, len(opt.RedactFields))}
+	for _, field := range opt.RedactFields {
+		l.redact[strings.ToLower(field)] = true
+	}
+	server.accessLog = l
+}
+
+func (l *accessLogger) write(req *request, latency time.Duration) {
+	if l == nil || !req.sampled && req.h.Error == "" && req.h.Code == 0 { // 出错的请求总是记录
+		return
+	}
+	args := req.args
+	if args == nil && !req.invoked { // 没有调用方法，argv不会被并发修改，记录时再序列化
+		args = l.requestArgs(req.argv)
+	}
+	record := &accessRecord{
+		Time:          req.start,
+		RemoteAddr:    req.remoteAddr,
+		ServiceMethod: req.h.ServiceMethod,
+		Seq:           req.h.Seq,
+		LatencyMs:     float64(latency) / float64(time.Millisecond),
+		RequestSize:   req.reqSize,
+		ResponseSize:  req.respSize,
+		Code:          req.h.Code.String(),
+		Error:         req.h.Error,
+		Args:          args,
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.opt.Writer.Write(line)
+}
+
+// 读取请求时决定是否采样，没有被采样的请求不需要提前序列化参数
+func (l *accessLogger) sample() bool {
+	if l == nil {
+		return false
+	}
+	rate := l.opt.SampleRate
+	return rate <= 0 || rate >= 1 || rand.Float64() < rate
+}
+
+// 调用方法之前序列化参数，避免和超时后仍在执行的方法同时访问argv，没有开启LogArgs时返回nil
+func (l *accessLogger) requestArgs(argv reflect.Value) json.RawMessage {
+	if l == nil || !l.opt.LogArgs || !argv.IsValid() {
+		return nil
+	}
+	return l.args(argv.Interface())
+}
+
+// 将参数序列化为JSON并替换需要隐藏的字段
+func (l *accessLogger) args(argv any) json.RawMessage {
+	data, err := json.Marshal(argv)
+	if err != nil || len(l.redact) == 0 {
+		if err != nil {
+			data, _ = json.Marshal(err.Error())
+		}
+		return data
+	}
+	var v any
+	if err = json.Unmarshal(data, &v); err != nil {
+		return data
+	}
+	data, _ = json.Marshal(l.redactValue(v))
+	return data
+}
+
+func (l *accessLogger) redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if l.redact[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = l.redactValue(value)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = l.redactValue(value)
+		}
+	}
+	return v
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"go-rpc/logger"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDebugPath 调试页面的默认路径
+const DefaultDebugPath = "/debug/go_rpc"
+
+const debugText = `<html>
+	<head><title>GoRPC Services</title></head>
+	<body>
+	{{range .}}
+	<hr>
+	Service {{.Name}}
+	<hr>
+		<table>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Errors</th><th align=center>Panics</th><th align=center>Avg Latency</th>
+		{{range .Methods}}
+			<tr>
+			<td align=left font=fixed>{{.Name}}({{.ArgType}}, {{.ReplyType}}) error</td>
+			<td align=center>{{.NumCalls}}</td>
+			<td align=center>{{.NumErrors}}</td>
+			<td align=center>{{.NumPanics}}</td>
+			<td align=center>{{.AvgLatency}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	</body>
+	</html>`
+
+var debugTemplate = template.Must(template.New("RPC debug").Parse(debugText))
+
+// 调试页面中服务的统计信息
+type debugService struct {
+	Name    string
+	Methods []debugMethod
+}
+
+// 调试页面中方法的统计信息
+type debugMethod struct {
+	Name       string
+	ArgType    string
+	ReplyType  string
+	NumCalls   uint64
+	NumErrors  uint64
+	NumPanics  uint64
+	AvgLatency time.Duration
+}
+
+type debugHTTP struct {
+	server *Server
+}
+
+// DebugHandler 返回渲染已注册服务、方法及调用统计的调试页面，可以和ServeHTTP挂载在同一个listener上
+func (server *Server) DebugHandler() http.Handler {
+	return debugHTTP{server: server}
+}
+
+func (d debugHTTP) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var services []debugService
+	d.server.serviceMap.Range(func(_, v any) bool {
+		s := v.(*Service)
+		ds := debugService{Name: s.name}
+		for name, m := range s.Method {
+			ds.Methods = append(ds.Methods, debugMethod{
+				Name:       name,
+				ArgType:    m.ArgType.String(),
+				ReplyType:  m.ReplyType.String(),
+				NumCalls:   atomic.LoadUint64(&m.NumCalls),
+				NumErrors:  atomic.LoadUint64(&m.NumErrors),
+				NumPanics:  atomic.LoadUint64(&m.NumPanics),
+				AvgLatency: m.AvgLatency(),
+			})
+		}
+		sort.Slice(ds.Methods, func(i, j int) bool { return ds.Methods[i].Name < ds.Methods[j].Name })
+		services = append(services, ds)
+		return true
+	})
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	if err := debugTemplate.Execute(w, services); err != nil {
+		d.server.logger.Warn("rpc server: execute debug template error", logger.Err(err))
+	}
+}
@@ -5,9 +5,13 @@ go 1.19
 require (
 	go-rpc/codec v0.0.1
 	go-rpc/service v0.0.1
+	go-rpc/metrics v0.0.1
+	go-rpc/logger v0.0.1
 )
 
 replace (
 	go-rpc/codec => ../codec
 	go-rpc/service => ../service
+	go-rpc/metrics => ../metrics
+	go-rpc/logger => ../logger
 )
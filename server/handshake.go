@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-rpc/codec"
+	"io"
+	"sort"
+	"time"
+)
+
+/*
+  1. 建立连接后客户端先发送握手请求，服务端校验后返回确认帧，之后才进入codec的分帧阶段
+  2. 握手请求: | magic(4) | version(1) | features(2) | codecLen(1) | codec | connectTimeout(8) | handlerTimeout(8) |
+              | compressLen(1) | compress | compressThreshold(4) |
+  3. 确认帧:   | version(1) | status(1) | features(2) | msgLen(2) | msg | codecCount(1) | codecLen(1) | codec | ... |
+              | compressLen(1) | compress |
+  4. 握手使用定长字段和io.ReadFull读取，不会多读属于后续帧的字节
+  5. 客户端请求的codec不被支持时，服务端在确认帧中返回支持的codec列表，客户端可以在同一连接上重新握手
+*/
+
+const (
+	ProtocolVersion      uint8 = 1 // 协议版本
+	maxHandshakeAttempts       = 2 // 同一连接上最多的握手次数，留给客户端一次重新协商codec的机会
+)
+
+// Feature 握手阶段协商的特性，按位表示
+type Feature uint16
+
+const (
+	FeatureCancel Feature = 1 << iota // 支持客户端发送取消控制消息
+)
+
+// SupportedFeatures 当前实现支持的特性，服务端确认的是双方的交集
+const SupportedFeatures = FeatureCancel
+
+// AckStatus 握手结果
+type AckStatus uint8
+
+const (
+	AckOK          AckStatus = iota // 握手成功
+	AckBadMagic                     // 不是rpc请求
+	AckBadVersion                   // 协议版本不兼容
+	AckUnsupported                  // 不支持的codec
+	AckBusy                         // 达到连接数上限
+)
+
+// Handshake 客户端发送的握手请求
+type Handshake struct {
+	Version  uint8
+	Features Feature
+	Option   Option
+}
+
+// Ack 服务端返回的确认帧
+type Ack struct {
+	Version  uint8
+	Status   AckStatus
+	Features Feature            // 双方都支持的特性
+	Message  string             // 握手失败时的错误信息
+	Codecs   []codec.Type       // 服务端支持的codec
+	Compress codec.CompressType // 服务端接受的压缩方式，为空表示不压缩
+}
+
+// ErrBadMagic 握手请求的魔数不正确，对端不是rpc客户端
+var ErrBadMagic = errors.New("rpc handshake: invalid magic number")
+
+// WriteHandshake 输出握手请求
+func WriteHandshake(w io.Writer, hs *Handshake) error {
+	if len(hs.Option.CodecType) > 0xff || len(hs.Option.Compress) > 0xff {
+		return fmt.Errorf("rpc handshake: codec or compress type too long: %s, %s", hs.Option.CodecType, hs.Option.Compress)
+	}
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(hs.Option.MagicNumber))
+	buf.WriteByte(hs.Version)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(hs.Features))
+	buf.WriteByte(byte(len(hs.Option.CodecType)))
+	buf.WriteString(string(hs.Option.CodecType))
+	_ = binary.Write(&buf, binary.BigEndian, int64(hs.Option.ConnectTimeout))
+	_ = binary.Write(&buf, binary.BigEndian, int64(hs.Option.HandlerTimeout))
+	buf.WriteByte(byte(len(hs.Option.Compress)))
+	buf.WriteString(string(hs.Option.Compress))
+	_ = binary.Write(&buf, binary.BigEndian, uint32(hs.Option.CompressThreshold))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadHandshake 读取握手请求
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	var head [8]byte // magic + version + features + codecLen
+	if _, err := io.ReadFull(r, head[:4]); err != nil {
+		return nil, err
+	}
+	hs := &Handshake{}
+	// 先校验魔数，不是rpc客户端时不再等待后续的数据
+	if hs.Option.MagicNumber = int(binary.BigEndian.Uint32(head[:4])); hs.Option.MagicNumber != MagicNumber {
+		return hs, fmt.Errorf("%w: %#x", ErrBadMagic, hs.Option.MagicNumber)
+	}
+	if _, err := io.ReadFull(r, head[4:]); err != nil {
+		return nil, err
+	}
+	hs.Version = head[4]
+	hs.Features = Feature(binary.BigEndian.Uint16(head[5:7]))
+	rest := make([]byte, int(head[7])+16) // codec + 两个超时时间
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	n := int(head[7])
+	hs.Option.CodecType = codec.Type(rest[:n])
+	hs.Option.ConnectTimeout = time.Duration(binary.BigEndian.Uint64(rest[n : n+8]))
+	hs.Option.HandlerTimeout = time.Duration(binary.BigEndian.Uint64(rest[n+8:]))
+	compress, err := readShortString(r)
+	if err != nil {
+		return nil, err
+	}
+	hs.Option.Compress = codec.CompressType(compress)
+	var threshold [4]byte
+	if _, err := io.ReadFull(r, threshold[:]); err != nil {
+		return nil, err
+	}
+	hs.Option.CompressThreshold = int(binary.BigEndian.Uint32(threshold[:]))
+	return hs, nil
+}
+
+// WriteAck 输出确认帧
+func WriteAck(w io.Writer, ack *Ack) error {
+	if len(ack.Message) > 0xffff {
+		return errors.New("rpc handshake: ack message too long")
+	}
+	if len(ack.Codecs) > 0xff {
+		return fmt.Errorf("rpc handshake: too many codecs: %d", len(ack.Codecs))
+	}
+	for _, typ := range ack.Codecs {
+		if len(typ) > 0xff {
+			return fmt.Errorf("rpc handshake: codec type too long: %s", typ)
+		}
+	}
+	if len(ack.Compress) > 0xff {
+		return fmt.Errorf("rpc handshake: compress type too long: %s", ack.Compress)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(ack.Version)
+	buf.WriteByte(byte(ack.Status))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(ack.Features))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(ack.Message)))
+	buf.WriteString(ack.Message)
+	buf.WriteByte(byte(len(ack.Codecs)))
+	for _, typ := range ack.Codecs {
+		buf.WriteByte(byte(len(typ)))
+		buf.WriteString(string(typ))
+	}
+	buf.WriteByte(byte(len(ack.Compress)))
+	buf.WriteString(string(ack.Compress))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadAck 读取确认帧
+func ReadAck(r io.Reader) (*Ack, error) {
+	var head [6]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	ack := &Ack{
+		Version:  head[0],
+		Status:   AckStatus(head[1]),
+		Features: Feature(binary.BigEndian.Uint16(head[2:4])),
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(head[4:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	ack.Message = string(msg)
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(n[0]); i++ {
+		typ, err := readShortString(r)
+		if err != nil {
+			return nil, err
+		}
+		ack.Codecs = append(ack.Codecs, codec.Type(typ))
+	}
+	compress, err := readShortString(r)
+	if err != nil {
+		return nil, err
+	}
+	ack.Compress = codec.CompressType(compress)
+	return ack, nil
+}
+
+// 读取一个字节长度前缀的字符串
+func readShortString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	s := make([]byte, n[0])
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// 服务端支持的codec列表，排序保证输出稳定，超出确认帧长度限制的名称和数量不会发送
+func supportedCodecs() []codec.Type {
+	codecs := make([]codec.Type, 0, len(codec.NewCodecFuncMap))
+	for typ := range codec.NewCodecFuncMap {
+		if len(typ) <= 0xff {
+			codecs = append(codecs, typ)
+		}
+	}
+	sort.Slice(codecs, func(i, j int) bool { return codecs[i] < codecs[j] })
+	if len(codecs) > 0xff {
+		codecs = codecs[:0xff]
+	}
+	return codecs
+}
+
+// SetCompressor 按照option为codec设置压缩方式，返回实际使用的压缩方式，压缩方式未注册或者codec没有实现codec.Compressible时不压缩
+func SetCompressor(c codec.Codec, opt *Option) codec.CompressType {
+	compressor := codec.CompressorMap[opt.Compress]
+	cc, ok := c.(codec.Compressible)
+	if opt.Compress == codec.NoCompress || compressor == nil || !ok {
+		return codec.NoCompress
+	}
+	threshold := opt.CompressThreshold
+	if threshold == 0 {
+		threshold = codec.DefaultCompressThreshold
+	}
+	cc.SetCompressor(compressor, threshold)
+	return opt.Compress
+}
+
+// 校验握手请求并生成确认帧
+func (server *Server) handshake(hs *Handshake) *Ack {
+	ack := &Ack{Version: ProtocolVersion, Status: AckOK, Features: hs.Features & SupportedFeatures, Codecs: supportedCodecs()}
+	switch {
+	case hs.Option.MagicNumber != MagicNumber:
+		ack.Status = AckBadMagic
+		ack.Message = fmt.Sprintf("invalid magic number: %#x", hs.Option.MagicNumber)
+	case hs.Version != ProtocolVersion:
+		ack.Status = AckBadVersion
+		ack.Message = fmt.Sprintf("unsupported protocol version %d, server speaks %d", hs.Version, ProtocolVersion)
+	case codec.NewCodecFuncMap[hs.Option.CodecType] == nil:
+		ack.Status = AckUnsupported
+		ack.Message = fmt.Sprintf("no impl by codecType: %s", hs.Option.CodecType)
+	}
+	return ack
+}
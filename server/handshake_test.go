@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"go-rpc/codec"
+	"go-rpc/logger"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	var buf bytes.Buffer
+	hs := &Handshake{Version: ProtocolVersion, Option: Option{MagicNumber: MagicNumber, CodecType: codec.GobType, ConnectTimeout: time.Second, HandlerTimeout: time.Minute}}
+	if err := WriteHandshake(&buf, hs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadHandshake(&buf)
+	if err != nil || *got != *hs || buf.Len() != 0 {
+		t.Fatalf("failed to read handshake: %v, %+v", err, got)
+	}
+	got.Option.CodecType = "application/unknown"
+	ack := NewServer().handshake(got)
+	if err := WriteAck(&buf, ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := ReadAck(&buf); err != nil || ack.Status != AckUnsupported || ack.Message == "" {
+		t.Errorf("expect codec rejected, got %v, %+v", err, ack)
+	}
+}
+
+func TestAckTooManyCodecs(t *testing.T) {
+	codecs := make([]codec.Type, 0x100)
+	for i := range codecs {
+		codecs[i] = codec.Type(fmt.Sprintf("application/x-%d", i))
+	}
+	var buf bytes.Buffer
+	if err := WriteAck(&buf, &Ack{Version: ProtocolVersion, Codecs: codecs}); err == nil {
+		t.Error("expect error when the codec count overflows a byte")
+	}
+
+	for _, typ := range codecs {
+		codec.NewCodecFuncMap[typ] = codec.NewJsonCodec
+	}
+	defer func() {
+		for _, typ := range codecs {
+			delete(codec.NewCodecFuncMap, typ)
+		}
+	}()
+	ack := &Ack{Version: ProtocolVersion, Codecs: supportedCodecs()}
+	if err := WriteAck(&buf, ack); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadAck(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Codecs) != 0xff || buf.Len() != 0 {
+		t.Errorf("expect codec list capped at 255, got %d codecs", len(got.Codecs))
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	s := NewServer()
+	s.SetLimits(Limits{MaxConns: 1, Policy: RejectOnLimit, HandshakeTimeout: 50 * time.Millisecond})
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+
+	// 只连接不握手的客户端在超时后被关闭，不再占用连接数
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = idle.Close() }()
+	_ = idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect idle conn closed by server, got %v", err)
+	}
+	time.Sleep(20 * time.Millisecond) // 等待服务端释放连接数
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if err := WriteHandshake(conn, &Handshake{Version: ProtocolVersion, Option: *DefaultOption}); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := ReadAck(conn); err != nil || ack.Status != AckOK {
+		t.Fatalf("expect handshake accepted, got %v, %+v", err, ack)
+	}
+	// 握手完成后清除超时，空闲的连接不会被关闭
+	time.Sleep(100 * time.Millisecond)
+	c := codec.NewCodecFuncMap[DefaultOption.CodecType](conn)
+	var resp codec.Header
+	if err := c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, nil); err != nil || c.ReadHeader(&resp) != nil || resp.Seq != 1 {
+		t.Errorf("expect conn alive after handshake, got %v, %+v", err, resp)
+	}
+}
+
+func TestHandshakeBadMagic(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer func() { _ = c1.Close() }()
+	go NewServer().ServerConn(c2)
+	// 不是rpc客户端时只读取魔数就拒绝，不等待后续的数据
+	if _, err := c1.Write([]byte("GET ")); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := ReadAck(c1); err != nil || ack.Status != AckBadMagic {
+		t.Errorf("expect bad magic, got %v, %+v", err, ack)
+	}
+}
+
+func TestHandshakeFallback(t *testing.T) {
+	hs := &Handshake{Version: ProtocolVersion, Option: *DefaultOption}
+	hs.Option.CodecType = "application/unknown"
+
+	c1, c2 := net.Pipe()
+	defer func() { _ = c1.Close() }()
+	go NewServer().ServerConn(c2)
+	if err := WriteHandshake(c1, hs); err != nil {
+		t.Fatal(err)
+	}
+	ack, err := ReadAck(c1)
+	want := []codec.Type{codec.GobType, codec.JsonType}
+	if err != nil || ack.Status != AckUnsupported || !reflect.DeepEqual(ack.Codecs, want) {
+		t.Fatalf("expect codecs %v advertised, got %v, %+v", want, err, ack)
+	}
+	// 使用服务端支持的codec重新握手
+	hs.Option.CodecType = ack.Codecs[0]
+	if err := WriteHandshake(c1, hs); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := ReadAck(c1); err != nil || ack.Status != AckOK {
+		t.Fatalf("expect re-handshake accepted, got %v, %+v", err, ack)
+	}
+
+	// 超过最大握手次数后连接被关闭
+	c3, c4 := net.Pipe()
+	defer func() { _ = c3.Close() }()
+	go NewServer().ServerConn(c4)
+	hs.Option.CodecType = "application/unknown"
+	for i := 1; i <= maxHandshakeAttempts; i++ {
+		if err := WriteHandshake(c3, hs); err != nil {
+			t.Fatal(err)
+		}
+		if ack, err := ReadAck(c3); err != nil || ack.Status != AckUnsupported {
+			t.Fatalf("attempt %d: expect codec rejected, got %v, %+v", i, err, ack)
+		}
+	}
+	if err := WriteHandshake(c3, hs); err == nil {
+		t.Errorf("expect conn closed after %d attempts", maxHandshakeAttempts)
+	}
+}
+
+func TestCompressFallback(t *testing.T) {
+	// 没有实现codec.Compressible的自定义codec
+	const plainType codec.Type = "application/x-plain"
+	codec.NewCodecFuncMap[plainType] = func(conn io.ReadWriteCloser) codec.Codec {
+		return struct{ codec.Codec }{codec.NewGobCodec(conn)}
+	}
+	defer delete(codec.NewCodecFuncMap, plainType)
+
+	var buf syncBuffer
+	s := NewServer()
+	s.SetLogger(logger.New(&buf, logger.WarnLevel))
+	c1, c2 := net.Pipe()
+	defer func() { _ = c1.Close() }()
+	go s.ServerConn(c2)
+	hs := &Handshake{Version: ProtocolVersion, Option: *DefaultOption}
+	hs.Option.CodecType, hs.Option.Compress = plainType, codec.GzipCompress
+	if err := WriteHandshake(c1, hs); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := ReadAck(c1); err != nil || ack.Status != AckOK || ack.Compress != codec.NoCompress {
+		t.Fatalf("expect compression dropped, got %v, %+v", err, ack)
+	}
+	if !strings.Contains(buf.String(), "compression not supported") {
+		t.Errorf("expect dropped compression logged, got %s", buf.String())
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"go-rpc/codec"
+	"reflect"
+)
+
+// CallInfo 拦截器可以获取的调用信息
+type CallInfo struct {
+	ServiceMethod string         // 服务名和方法名，如Foo.Sum
+	Service       string         // 服务名
+	Method        string         // 方法名
+	Seq           uint64         // 请求的序号
+	Metadata      codec.Metadata // 请求携带的元数据
+	RemoteAddr    string         // 客户端地址，连接不是net.Conn时为空
+}
+
+// Handler 真正调用service中方法的处理函数
+type Handler func(ctx context.Context, argv, reply any) error
+
+// Interceptor 一元拦截器，调用handler继续执行后续的拦截器和方法，直接返回error即可短路
+type Interceptor func(ctx context.Context, info *CallInfo, argv, reply any, handler Handler) error
+
+// Use 注册拦截器，按照注册的顺序由外到内执行，需要在开始处理请求之前调用
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+// 依次经过拦截器后调用service中的方法
+func (server *Server) invoke(ctx context.Context, req *request) error {
+	info := &CallInfo{
+		ServiceMethod: req.h.ServiceMethod,
+		Service:       req.service.name,
+		Method:        req.mType.method.Name,
+		Seq:           req.h.Seq,
+		Metadata:      codec.IncomingFromContext(ctx),
+		RemoteAddr:    req.remoteAddr,
+	}
+	var handler Handler = func(ctx context.Context, argv, reply any) error {
+		return req.service.CallContext(ctx, req.mType, reflect.ValueOf(argv), reflect.ValueOf(reply))
+	}
+	handler = chainInterceptors(server.interceptors, info, handler)
+	return handler(ctx, req.argv.Interface(), req.reply.Interface())
+}
+
+// 从最后一个拦截器开始包装，保证第一个注册的拦截器最先执行
+func chainInterceptors(interceptors []Interceptor, info *CallInfo, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, argv, reply any) error {
+			return interceptor(ctx, info, argv, reply, next)
+		}
+	}
+	return handler
+}
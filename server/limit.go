@@ -0,0 +1,139 @@
+package server
+
+import (
+	"go-rpc/codec"
+	"time"
+)
+
+// ErrServerBusy 达到连接数或者并发请求数上限，请求被拒绝
+var ErrServerBusy error = codec.NewStatus(codec.CodeServerBusy, "rpc server: server busy")
+
+// LimitPolicy 达到上限时的处理方式
+type LimitPolicy int
+
+const (
+	QueueOnLimit  LimitPolicy = iota // 排队等待，连接暂停Accept，请求在服务端排队，连接仍然读取取消等控制消息
+	RejectOnLimit                    // 直接拒绝，返回ErrServerBusy
+)
+
+// Limits 服务端的连接数和并发请求数限制，0表示不限制
+type Limits struct {
+	MaxConns        int         // 最大连接数
+	MaxConnRequests int         // 每个连接同时处理的最大请求数
+	MaxRequests     int         // 全局同时处理的最大请求数
+	Policy          LimitPolicy // 达到上限时的处理方式
+	// MaxQueuedRequests、MaxConnQueuedRequests 排队模式下全局和每个连接等待许可的最大请求数，
+	// 超出时返回ErrServerBusy，为0时使用DefaultMaxQueuedRequests和DefaultMaxConnQueuedRequests，小于0表示不限制
+	MaxQueuedRequests     int
+	MaxConnQueuedRequests int
+	// HandshakeTimeout 读取握手请求的超时时间，避免只连接不握手的客户端一直占用连接数，
+	// 为0时使用DefaultHandshakeTimeout，小于0表示不限制
+	HandshakeTimeout time.Duration
+}
+
+const (
+	DefaultHandshakeTimeout      = 10 * time.Second // 默认的握手超时时间
+	DefaultMaxQueuedRequests     = 1024             // 默认全局等待许可的最大请求数
+	DefaultMaxConnQueuedRequests = 128              // 默认每个连接等待许可的最大请求数
+)
+
+// SetLimits 设置连接数和并发请求数限制，需要在开始处理请求之前调用
+func (server *Server) SetLimits(limits Limits) {
+	server.limits = limits
+	server.connSem = newSemaphore(limits.MaxConns)
+	server.reqSem = newSemaphore(limits.MaxRequests)
+	server.queueSem = newSemaphore(queueLimit(limits.MaxQueuedRequests, DefaultMaxQueuedRequests))
+}
+
+// 等待许可的请求数上限，为0时使用默认值，小于0表示不限制
+func queueLimit(n, def int) int {
+	if n == 0 {
+		return def
+	}
+	return n
+}
+
+// 握手的超时时间，小于等于0表示不限制
+func (server *Server) handshakeTimeout() time.Duration {
+	if server.limits.HandshakeTimeout == 0 {
+		return DefaultHandshakeTimeout
+	}
+	return server.limits.HandshakeTimeout
+}
+
+// 基于带缓冲通道的信号量，nil表示不限制
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// 获取许可，block为true时阻塞等待，直到获取成功或者done、cancel被关闭，cancel可以为nil
+func (s semaphore) acquire(block bool, done, cancel <-chan struct{}) bool {
+	if s == nil {
+		return true
+	}
+	if !block {
+		select {
+		case s <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	case <-cancel:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+func (server *Server) queueOnLimit() bool {
+	return server.limits.Policy == QueueOnLimit
+}
+
+// 获取请求的许可，先获取连接级别的再获取全局的，block为true时阻塞等待，直到获取成功或者服务端关闭、cancel被关闭
+func (server *Server) acquireRequest(connSem semaphore, block bool, cancel <-chan struct{}) bool {
+	if !connSem.acquire(block, server.done, cancel) {
+		return false
+	}
+	if !server.reqSem.acquire(block, server.done, cancel) {
+		connSem.release()
+		return false
+	}
+	return true
+}
+
+func (server *Server) releaseRequest(connSem semaphore) {
+	server.reqSem.release()
+	connSem.release()
+}
+
+// 获取排队等待许可的名额，先获取连接级别的再获取全局的，不会阻塞
+func (server *Server) acquireQueue(connQueue semaphore) bool {
+	if !connQueue.acquire(false, nil, nil) {
+		return false
+	}
+	if !server.queueSem.acquire(false, nil, nil) {
+		connQueue.release()
+		return false
+	}
+	return true
+}
+
+func (server *Server) releaseQueue(connQueue semaphore) {
+	server.queueSem.release()
+	connQueue.release()
+}
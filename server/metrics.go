@@ -0,0 +1,77 @@
+package server
+
+import (
+	"go-rpc/codec"
+	"go-rpc/metrics"
+	"time"
+)
+
+// 找不到服务或者方法时使用的method标签，避免客户端传入任意名称导致标签数量无限增长
+const unknownMethod = "unknown"
+
+// 服务端的指标，为nil时不记录
+type serverMetrics struct {
+	requests   *metrics.CounterVec   // 按方法统计的请求数
+	errors     *metrics.CounterVec   // 按方法和错误码统计的错误数
+	latency    *metrics.HistogramVec // 按方法统计的处理延迟
+	inFlight   *metrics.GaugeVec     // 按方法统计的正在处理的请求数
+	conns      metrics.Gauge         // 当前的连接数
+	connsTotal metrics.Counter       // 累计接受的连接数
+}
+
+// SetMetrics 将请求数、错误数、延迟、正在处理的请求数和连接数记录到r中，需要在Accept之前调用
+func (server *Server) SetMetrics(r *metrics.Registry) {
+	server.metrics = &serverMetrics{
+		requests:   r.Counter("go_rpc_server_requests_total", "Total number of requests handled by the server.", "method"),
+		errors:     r.Counter("go_rpc_server_errors_total", "Total number of requests that returned an error, by code.", "method", "code"),
+		latency:    r.Histogram("go_rpc_server_request_duration_seconds", "Request handling latency in seconds.", nil, "method"),
+		inFlight:   r.Gauge("go_rpc_server_in_flight_requests", "Number of requests currently being handled.", "method"),
+		conns:      r.Gauge("go_rpc_server_connections", "Number of open connections.").With(),
+		connsTotal: r.Counter("go_rpc_server_connections_total", "Total number of accepted connections.").With(),
+	}
+}
+
+func (m *serverMetrics) connOpened() {
+	if m != nil {
+		m.conns.Inc()
+		m.connsTotal.Inc()
+	}
+}
+
+func (m *serverMetrics) connClosed() {
+	if m != nil {
+		m.conns.Dec()
+	}
+}
+
+func (m *serverMetrics) start(method string) {
+	if m != nil {
+		m.inFlight.With(method).Inc()
+	}
+}
+
+func (m *serverMetrics) finish(method string) {
+	if m != nil {
+		m.inFlight.With(method).Dec()
+	}
+}
+
+// 记录请求的结果，code为CodeOK表示成功
+func (m *serverMetrics) observe(method string, code codec.Code, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.With(method).Inc()
+	if code != codec.CodeOK {
+		m.errors.With(method, code.String()).Inc()
+	}
+	m.latency.With(method).Observe(d.Seconds())
+}
+
+// 请求的method标签
+func (req *request) method() string {
+	if req.mType == nil {
+		return unknownMethod
+	}
+	return req.h.ServiceMethod
+}
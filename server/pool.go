@@ -0,0 +1,124 @@
+package server
+
+import "sync"
+
+// PoolOption 工作池配置
+type PoolOption struct {
+	Size int // worker数量
+	// QueueLen 没有空闲worker时池内等待队列的长度，队列已满时返回ErrServerBusy，不会阻塞连接的读取，
+	// 为0时使用DefaultPoolQueueLen，小于0表示不排队
+	QueueLen int
+}
+
+// DefaultPoolQueueLen 默认的工作池等待队列长度
+const DefaultPoolQueueLen = 1024
+
+// 固定数量worker的工作池，worker随server常驻，等待执行的任务在池内排队
+type workerPool struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []func() // 等待执行的任务
+	idle     int      // 空闲的worker数量
+	queueLen int
+	closed   bool
+}
+
+func newWorkerPool(opt PoolOption) *workerPool {
+	if opt.Size <= 0 {
+		opt.Size = 1
+	}
+	if opt.QueueLen == 0 {
+		opt.QueueLen = DefaultPoolQueueLen
+	} else if opt.QueueLen < 0 {
+		opt.QueueLen = 0
+	}
+	p := &workerPool{queueLen: opt.QueueLen}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < opt.Size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// 依次执行排队的任务，关闭后执行完剩余的任务再退出
+func (p *workerPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.pending) == 0 && !p.closed {
+			p.idle++
+			p.cond.Wait()
+			p.idle--
+		}
+		if len(p.pending) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		task := p.pending[0]
+		p.pending[0] = nil
+		p.pending = p.pending[1:]
+		p.mu.Unlock()
+		task()
+	}
+}
+
+// 提交任务，不会阻塞调用方。没有空闲的worker并且等待队列已满时拒绝，否则在池内排队
+func (p *workerPool) submit(task func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.pending) >= p.idle+p.queueLen {
+		return false
+	}
+	p.pending = append(p.pending, task)
+	p.cond.Signal()
+	return true
+}
+
+// 关闭工作池，不再接收新的任务
+func (p *workerPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// SetWorkerPool 使用工作池代替每个请求一个goroutine，需要在开始处理请求之前调用
+func (server *Server) SetWorkerPool(opt PoolOption) {
+	server.pool.close() // 替换时关闭之前的工作池
+	server.pool = newWorkerPool(opt)
+}
+
+// SetServicePool 为服务(如Foo)或者方法(如Foo.Sleep)设置独立的工作池，慢服务不会占满其他服务的worker
+func (server *Server) SetServicePool(name string, opt PoolOption) {
+	if server.servicePools == nil {
+		server.servicePools = make(map[string]*workerPool)
+	}
+	server.servicePools[name].close()
+	server.servicePools[name] = newWorkerPool(opt)
+}
+
+// 关闭所有工作池，worker执行完已经排队的任务后退出
+func (server *Server) closePools() {
+	server.pool.close()
+	for _, pool := range server.servicePools {
+		pool.close()
+	}
+}
+
+// 按照方法、服务、默认的顺序选择工作池，没有配置工作池时直接启动goroutine
+func (server *Server) dispatch(req *request, task func()) bool {
+	pool := server.servicePools[req.h.ServiceMethod]
+	if pool == nil {
+		pool = server.servicePools[req.service.name]
+	}
+	if pool == nil {
+		pool = server.pool
+	}
+	if pool == nil {
+		go task()
+		return true
+	}
+	return pool.submit(task)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"go-rpc/codec"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited 请求超过了方法的限流速率
+var ErrRateLimited error = codec.NewStatus(codec.CodeRateLimited, "rpc server: rate limited")
+
+const (
+	bucketSweepInterval = time.Minute // 清理空闲客户端令牌桶的间隔
+	DefaultMaxClients   = 10000       // 默认按照客户端限流时最多保留的令牌桶数量
+)
+
+// RateLimit 令牌桶限流配置
+type RateLimit struct {
+	Rate      float64 // 每秒生成的令牌数
+	Burst     int     // 令牌桶容量，至少为1
+	PerClient bool    // 是否按照客户端分别限流
+	// IdentityKey 识别客户端的元数据key，为空或者请求没有携带时使用远程地址。
+	// 该值由客户端自行传递，每次更换即可获得新的令牌桶，只应使用经过认证的可信值(如网关写入的用户ID)
+	IdentityKey string
+	// MaxClients 按照客户端限流时最多保留的令牌桶数量，达到上限时新的客户端共用一个令牌桶，
+	// 为0时使用DefaultMaxClients
+	MaxClients int
+}
+
+// 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 按照经过的时间补充令牌，有令牌时消耗一个
+func (b *tokenBucket) allow(limit *RateLimit, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if burst := float64(limit.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 是否已经补满，补满的令牌桶可以回收
+func (b *tokenBucket) full(limit *RateLimit, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst)
+}
+
+// 一个方法的限流器
+type rateLimiter struct {
+	limit     RateLimit
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket // 客户端标识 -> 令牌桶，不区分客户端时只有一个空字符串的key
+	lastSweep time.Time
+}
+
+func (l *rateLimiter) allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if !l.limit.PerClient {
+		client = ""
+	}
+	if l.limit.PerClient && now.Sub(l.lastSweep) > bucketSweepInterval { // 定期回收空闲客户端的令牌桶
+		l.sweep(now)
+	}
+	b := l.buckets[client]
+	if b == nil && len(l.buckets) >= l.limit.MaxClients { // 达到上限时先回收，仍然没有空间则共用溢出的令牌桶
+		l.sweep(now)
+		if len(l.buckets) >= l.limit.MaxClients {
+			client = overflowClient
+			b = l.buckets[client]
+		}
+	}
+	if b == nil {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[client] = b
+	}
+	return b.allow(&l.limit, now)
+}
+
+// 令牌桶数量达到上限后新的客户端共用的key，不会和远程地址或者元数据冲突
+const overflowClient = "\x00overflow"
+
+// 回收已经补满的令牌桶，补满的令牌桶和新建的没有区别
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if key != overflowClient && bucket.full(&l.limit, now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// SetRateLimit 为方法(如Foo.Sum)设置限流，需要在开始处理请求之前调用
+func (server *Server) SetRateLimit(serviceMethod string, limit RateLimit) {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	if limit.MaxClients <= 0 {
+		limit.MaxClients = DefaultMaxClients
+	}
+	if server.rateLimiters == nil {
+		server.rateLimiters = make(map[string]*rateLimiter)
+	}
+	server.rateLimiters[serviceMethod] = &rateLimiter{
+		limit:     limit,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// 读取请求之后、获取许可和进入工作池之前检查限流
+func (server *Server) checkRateLimit(req *request) error {
+	l := server.rateLimiters[req.h.ServiceMethod]
+	if l == nil {
+		return nil
+	}
+	client := codec.IncomingFromContext(req.ctx).Get(l.limit.IdentityKey)
+	if l.limit.IdentityKey == "" || client == "" {
+		client = remoteHost(req.remoteAddr)
+	}
+	if !l.allow(client) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// 去掉客户端地址中的端口，同一主机重新建立连接时仍然共用令牌桶
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"go-rpc/codec"
+	"reflect"
+	"sort"
+)
+
+// Reflection 内置的反射服务，客户端可以通过Reflection.ListServices查询服务端提供的服务和方法
+type Reflection struct {
+	server *Server
+}
+
+// ServiceInfo 服务的描述
+type ServiceInfo struct {
+	Name    string       // 服务名称
+	Methods []MethodInfo // 按名称排序的方法
+}
+
+// MethodInfo 方法的描述
+type MethodInfo struct {
+	Name        string   // 方法名称
+	ArgType     TypeInfo // 请求参数类型
+	ReplyType   TypeInfo // 返回类型
+	WithContext bool     // 方法是否接收context.Context
+}
+
+// TypeInfo 参数类型的描述，结构体(或其指针)会列出导出的字段
+type TypeInfo struct {
+	Name   string      // 类型名称，如*service.Args
+	Kind   string      // 类型的种类，如ptr、struct、int
+	Fields []FieldInfo // 结构体的导出字段
+}
+
+// FieldInfo 结构体字段的描述
+type FieldInfo struct {
+	Name string // 字段名称
+	Type string // 字段类型
+}
+
+// ListServices 返回names中的服务，names为空时返回所有服务，结果按服务名排序
+func (r *Reflection) ListServices(names []string, reply *[]ServiceInfo) error {
+	filter := make(map[string]bool, len(names))
+	for _, name := range names {
+		filter[name] = true
+	}
+	services := make([]ServiceInfo, 0)
+	r.server.serviceMap.Range(func(_, v any) bool {
+		if s := v.(*Service); len(filter) == 0 || filter[s.name] {
+			services = append(services, describeService(s))
+		}
+		return true
+	})
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	*reply = services
+	return nil
+}
+
+// DescribeService 返回指定服务的描述，服务不存在时返回CodeNotFound
+func (r *Reflection) DescribeService(name string, reply *ServiceInfo) error {
+	s, ok := r.server.serviceMap.Load(name)
+	if !ok {
+		return codec.NewStatus(codec.CodeNotFound, "rpc server: can't find service "+name)
+	}
+	*reply = describeService(s.(*Service))
+	return nil
+}
+
+func describeService(s *Service) ServiceInfo {
+	info := ServiceInfo{Name: s.name, Methods: make([]MethodInfo, 0, len(s.Method))}
+	for name, m := range s.Method {
+		info.Methods = append(info.Methods, MethodInfo{
+			Name:        name,
+			ArgType:     describeType(m.ArgType),
+			ReplyType:   describeType(m.ReplyType),
+			WithContext: m.withContext,
+		})
+	}
+	sort.Slice(info.Methods, func(i, j int) bool { return info.Methods[i].Name < info.Methods[j].Name })
+	return info
+}
+
+func describeType(t reflect.Type) TypeInfo {
+	info := TypeInfo{Name: t.String(), Kind: t.Kind().String()}
+	st := t
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if st.Kind() == reflect.Struct {
+		for i := 0; i < st.NumField(); i++ {
+			if f := st.Field(i); f.IsExported() {
+				info.Fields = append(info.Fields, FieldInfo{Name: f.Name, Type: f.Type.String()})
+			}
+		}
+	}
+	return info
+}
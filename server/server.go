@@ -1,34 +1,44 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"go-rpc/codec"
+	"go-rpc/logger"
+	"go-rpc/metrics"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const MagicNumber = 0x3bef5c // 魔数
 
 /*
-  1. Option 固定使用json来序列化，至于body和header如何序列化由codec.Type决定
-  2. | option | Header1 | body1 | Header2 | body2 | ...
+  1. Option 通过固定格式的二进制握手发送(见handshake.go)，至于body和header如何序列化由codec.Type决定
+  2. | handshake | ack | Header1 | body1 | Header2 | body2 | ...
 */
 
 type Option struct {
-	MagicNumber    int           // 表明这是一个rpc请求
-	CodecType      codec.Type    // client使用何种方式来对body进行编码
-	ConnectTimeout time.Duration // 连接超时
-	HandlerTimeout time.Duration // 处理超时
+	MagicNumber       int                // 表明这是一个rpc请求
+	CodecType         codec.Type         // client使用何种方式来对body进行编码
+	ConnectTimeout    time.Duration      // 连接超时
+	HandlerTimeout    time.Duration      // 处理超时
+	Compress          codec.CompressType // body的压缩方式，服务端不支持或者codec没有实现codec.Compressible时退化为不压缩
+	CompressThreshold int                // 超过该长度的body才会压缩，为0时使用codec.DefaultCompressThreshold
+	Metrics           *metrics.Registry  // 客户端记录指标的位置，为nil时不记录，不参与握手
+	Logger            logger.Logger      // 客户端的日志，为nil时不输出，不参与握手
 }
 
+// ErrDeadlineExceeded 请求处理超过了连接的HandlerTimeout或者客户端传递的超时时间
+var ErrDeadlineExceeded error = codec.NewStatus(codec.CodeDeadlineExceeded, "rpc server: deadline exceeded")
+
 var DefaultOption = &Option{
 	MagicNumber:    MagicNumber,
 	CodecType:      codec.JsonType,
@@ -37,14 +47,37 @@ var DefaultOption = &Option{
 }
 
 type Server struct {
-	serviceMap sync.Map // 并发安全，注册service
+	serviceMap   sync.Map                  // 并发安全，注册service
+	interceptors []Interceptor             // 拦截器，在调用service中的方法前后执行
+	mu           sync.Mutex                // 保护listeners和conns
+	listeners    map[net.Listener]struct{} // 正在Accept的listener
+	conns        map[*serverConn]struct{}  // 正在处理的连接
+	done         chan struct{}             // 关闭时close，通知Accept和排队等待的请求
+	doneOnce     sync.Once
+	active       int64                   // 正在处理的请求数，原子操作
+	limits       Limits                  // 连接数和并发请求数限制
+	connSem      semaphore               // 连接数信号量
+	reqSem       semaphore               // 全局请求数信号量
+	queueSem     semaphore               // 全局等待许可的请求数信号量
+	pool         *workerPool             // 默认的工作池，为nil时每个请求一个goroutine
+	servicePools map[string]*workerPool  // 服务或者方法独立的工作池
+	rateLimiters map[string]*rateLimiter // 方法的限流器
+	logger       logger.Logger           // 日志，默认不输出
+	accessLog    *accessLogger           // 访问日志，为nil时不记录
+	metrics      *serverMetrics          // 为nil时不记录指标
 }
 
 func (server *Server) Register(service any) error {
-	s := NewService(service)
+	s, err := TryNewService(service)
+	if err != nil {
+		return err
+	}
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		return errors.New("rpc: service already defined: " + s.name)
 	}
+	for name := range s.Method {
+		server.logger.Info("rpc server: register", logger.ServiceMethod(s.name+"."+name))
+	}
 	return nil
 }
 
@@ -57,94 +90,289 @@ func (server *Server) findService(serviceMethod string) (service *Service, metho
 	// 校验 serviceMethod Foo.sum 并切割获取service和method名称
 	index := strings.LastIndex(serviceMethod, ".")
 	if index < 0 {
-		err = errors.New("rpc server: invalid service method")
+		err = codec.NewStatus(codec.CodeInvalidArgument, "rpc server: invalid service method")
 		return
 	}
 	serviceName, methodName := serviceMethod[:index], serviceMethod[index+1:]
 	// 获取service
 	svc, ok := server.serviceMap.Load(serviceName)
 	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
+		err = codec.NewStatus(codec.CodeNotFound, "rpc server: can't find service "+serviceName)
 		return
 	}
 	// 查找service中的method
 	service = svc.(*Service)
 	method = service.Method[methodName]
 	if method == nil {
-		err = errors.New("rpc server: can't find method " + methodName)
+		err = codec.NewStatus(codec.CodeNotFound, "rpc server: can't find method "+methodName)
 		return
 	}
 	return
 }
 
 func NewServer() *Server {
-	return &Server{}
+	server := &Server{
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*serverConn]struct{}),
+		done:      make(chan struct{}),
+		logger:    logger.Nop(),
+	}
+	_ = server.Register(&Reflection{server: server}) // 内置的反射服务
+	return server
+}
+
+// SetLogger 设置服务端的日志，为nil时不输出，需要在注册服务和开始处理请求之前调用
+func (server *Server) SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.Nop()
+	}
+	server.logger = l
 }
 
 var DefaultServer = NewServer()
 
+// Accept 循环接受连接，listener关闭或者服务端关闭时返回
 func (server *Server) Accept(listener net.Listener) {
+	if !server.trackListener(listener, true) {
+		_ = listener.Close()
+		return
+	}
+	defer server.trackListener(listener, false)
+	var delay time.Duration // 临时错误时的退避时间，避免空转
 	// for循环接受请求
 	for {
+		// 排队模式下达到连接数上限时暂停Accept，新的连接留在内核的backlog中
+		queued := server.connSem != nil && server.queueOnLimit()
+		if queued && !server.connSem.acquire(true, server.done, nil) {
+			return
+		}
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("rpc server -> accept error: ", err)
+			if queued {
+				server.connSem.release()
+			}
+			if server.shuttingDown() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if delay = 2 * delay; delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay > time.Second {
+				delay = time.Second
+			}
+			server.logger.Warn("rpc server: accept error, retrying", logger.Err(err), logger.F("delay", delay))
+			time.Sleep(delay)
+			continue
 		}
-		go server.ServerConn(conn) // 交给服务端实例处理
+		delay = 0
+		go server.serveConn(conn, queued) // 交给服务端实例处理
 	}
 }
 
 func (server *Server) ServerConn(conn io.ReadWriteCloser) {
+	server.serveConn(conn, false)
+}
+
+// acquired表示是否已经获取了连接数的许可
+func (server *Server) serveConn(conn io.ReadWriteCloser, acquired bool) {
+	if !acquired {
+		acquired = server.connSem.acquire(server.queueOnLimit(), server.done, nil)
+	}
+	if acquired {
+		defer server.connSem.release()
+	}
+	sc := &serverConn{rwc: conn, sending: new(sync.Mutex)}
+	if c, ok := conn.(net.Conn); ok {
+		sc.remoteAddr = c.RemoteAddr().String()
+	}
+	if !server.trackConn(sc, true) { // 正在关闭，不再处理新的连接
+		_ = conn.Close()
+		return
+	}
 	defer func() {
+		server.trackConn(sc, false)
 		_ = conn.Close()
 	}()
-	var option Option // 解码并设置到Option中
-	if err := json.NewDecoder(conn).Decode(&option); err != nil {
-		log.Println("rpc server -> decode error: ", err)
-		return
+	nc, isNetConn := conn.(net.Conn)
+	if timeout := server.handshakeTimeout(); isNetConn && timeout > 0 { // 握手完成后清除
+		_ = nc.SetReadDeadline(time.Now().Add(timeout))
 	}
-	if option.MagicNumber != MagicNumber {
-		log.Printf("rpc server -> invalid magic number: %d\n", option.MagicNumber)
-		return
+	var hs *Handshake
+	var c codec.Codec
+	for i := 1; ; i++ {
+		var err error
+		if hs, err = ReadHandshake(conn); err != nil { // 读取握手请求并设置到Option中
+			server.logger.Warn("rpc server: read handshake error", logger.RemoteAddr(sc.remoteAddr), logger.Err(err))
+			if errors.Is(err, ErrBadMagic) {
+				_ = WriteAck(conn, server.handshake(hs))
+			}
+			return
+		}
+		ack := server.handshake(hs)
+		if ack.Status == AckOK && !acquired { // 达到连接数上限，告知客户端服务繁忙
+			ack.Status, ack.Message = AckBusy, ErrServerBusy.Error()
+		}
+		if ack.Status == AckOK {
+			c = codec.NewCodecFuncMap[hs.Option.CodecType](conn) // 根据option传入的类型获取解析方法
+			if ack.Compress = SetCompressor(c, &hs.Option); ack.Compress != hs.Option.Compress {
+				server.logger.Warn("rpc server: compression not supported, fall back to no compression", logger.RemoteAddr(sc.remoteAddr),
+					logger.F("codec", hs.Option.CodecType), logger.F("compress", hs.Option.Compress))
+			}
+			err = sc.accept(c, ack)
+		} else {
+			err = WriteAck(conn, ack)
+		}
+		if err != nil {
+			server.logger.Warn("rpc server: write ack error", logger.RemoteAddr(sc.remoteAddr), logger.Err(err))
+			return
+		}
+		if ack.Status == AckOK {
+			break
+		}
+		if ack.Status != AckUnsupported || i == maxHandshakeAttempts { // 只有codec不支持时才允许重新握手
+			server.logger.Warn("rpc server: handshake rejected", logger.RemoteAddr(sc.remoteAddr), logger.F("reason", ack.Message))
+			return
+		}
 	}
-	f := codec.NewCodecFuncMap[option.CodecType] // 根据option传入的类型获取解析方法
-	if f == nil {
-		log.Printf("rpc server -> no impl by codecType: %s\n", option.CodecType)
-		return
+	if isNetConn {
+		_ = nc.SetReadDeadline(time.Time{})
 	}
-	server.serverCodec(f(conn), option.HandlerTimeout)
+	server.serverCodec(sc, hs.Option.HandlerTimeout)
 }
 
 var invalidRequest = struct{}{}
 
 // 一次连接可能有多个请求，所以需要for循环等待，直到错误发生退出
-func (server *Server) serverCodec(f codec.Codec, timeout time.Duration) {
-	sending := new(sync.Mutex) // 保证response有序
+func (server *Server) serverCodec(sc *serverConn, timeout time.Duration) {
+	f, sending := sc.c, sc.sending // sending保证response有序
 	wg := new(sync.WaitGroup)
+	connSem := newSemaphore(server.limits.MaxConnRequests) // 连接级别的请求数信号量
+	connQueue := newSemaphore(queueLimit(server.limits.MaxConnQueuedRequests, DefaultMaxConnQueuedRequests))
+	ctx, cancel := context.WithCancel(context.Background()) // 连接级别的上下文，连接关闭时取消所有请求
+	var pending sync.Map                                    // seq -> context.CancelFunc，处理客户端的取消请求
 	// 允许一次连接中，接收多个请求，即多个header和body
 	// 请求可以并发处理，但是响应必须是逐个发送
 	for {
-		req, err := server.readRequest(f) // 解析请求
-		if err != nil {                   // 如果解析失败，需要返回response
+		req, err := server.readRequest(ctx, f, sc.remoteAddr) // 解析请求
+		if err != nil {                                       // 如果解析失败，需要返回response
 			if req == nil { // 表示header解析失败，那么跳出这次请求
 				break
 			}
-			req.h.Error = err.Error()
-			server.sendResponse(f, req.h, invalidRequest, sending)
+			setError(req.h, err)
+			req.respSize = server.sendResponse(f, req.h, invalidRequest, sending)
+			server.record(req)
+			continue
+		}
+		if req.h.Control != codec.ControlNone { // 控制消息，不支持的类型直接忽略
+			if cancel, ok := pending.Load(req.h.Seq); ok && req.h.Control == codec.ControlCancel {
+				cancel.(context.CancelFunc)()
+			}
+			continue
+		}
+		atomic.AddInt64(&server.active, 1) // 先计数再判断，保证Shutdown等待时不会漏掉请求
+		if server.shuttingDown() {
+			server.rejectRequest(f, req, ErrServerShutdown, sending)
+			continue
+		}
+		// 在获取许可和进入工作池之前限流，超出速率的请求不会占用排队名额、许可和worker
+		if err := server.checkRateLimit(req); err != nil {
+			server.rejectRequest(f, req, err, sending)
 			continue
 		}
+		// 先在读取循环中尝试获取许可，排队时在单独的goroutine中等待许可，读取循环可以继续处理取消等控制消息，
+		// 等待许可的请求数有上限，避免突发的大量请求各自占用一个goroutine和请求参数耗尽内存
+		acquired := server.acquireRequest(connSem, false, nil)
+		queued := !acquired && server.queueOnLimit() && server.acquireQueue(connQueue)
+		if !acquired && !queued {
+			server.rejectRequest(f, req, ErrServerBusy, sending)
+			continue
+		}
+		req.initContext(timeout)
+		pending.Store(req.h.Seq, req.cancel)
+		server.metrics.start(req.method())
+		finish := func() { // handleRequest等方法真正返回后才会调用，超时不会提前释放许可
+			server.metrics.finish(req.method())
+			pending.Delete(req.h.Seq)
+			req.cancel()
+			if acquired {
+				server.releaseRequest(connSem)
+			}
+			atomic.AddInt64(&server.active, -1)
+		}
 		wg.Add(1)
-		go server.handleRequest(f, req, sending, wg, timeout) // 协程处理
+		if !queued {
+			server.submitRequest(f, req, sending, wg, finish)
+			continue
+		}
+		// 获取许可之后才交给工作池，等待本连接许可的请求不会占用worker，其他连接的请求不受影响
+		go func() {
+			acquired = server.acquireRequest(connSem, true, req.ctx.Done())
+			server.releaseQueue(connQueue)
+			if !acquired {
+				server.abortRequest(f, req, sending)
+				finish()
+				wg.Done()
+				return
+			}
+			server.submitRequest(f, req, sending, wg, finish)
+		}()
 	}
+	cancel()
 	wg.Wait()
 	_ = f.Close()
 }
 
+// 将已经获取许可的请求交给工作池处理，工作池队列已满时返回繁忙
+func (server *Server) submitRequest(f codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, finish func()) {
+	if server.dispatch(req, func() {
+		defer wg.Done()
+		server.handleRequest(f, req, sending)
+		finish()
+	}) {
+		return
+	}
+	wg.Done()
+	finish()
+	setError(req.h, ErrServerBusy)
+	req.respSize = server.sendResponse(f, req.h, invalidRequest, sending)
+	server.record(req)
+}
+
 type request struct {
-	h           *codec.Header // 请求的header
-	argv, reply reflect.Value // 请求的参数和响应参数
+	h           *codec.Header      // 请求的header
+	ctx         context.Context    // 携带请求元数据的上下文，通过codec.IncomingFromContext读取
+	cancel      context.CancelFunc // 客户端取消或者处理结束时取消ctx
+	timeout     time.Duration      // 客户端传递的超时时间，initContext之后为实际生效的超时时间
+	remoteAddr  string             // 客户端地址
+	argv, reply reflect.Value      // 请求的参数和响应参数
 	mType       *methodType
 	service     *Service
+	start       time.Time       // 读取到header的时间，用于统计延迟
+	reqSize     int             // 请求body的大小
+	respSize    int             // 响应body的大小
+	args        json.RawMessage // 访问日志记录的请求参数，调用方法之前序列化
+	sampled     bool            // 访问日志是否采样该请求
+	invoked     bool            // 是否已经开始调用方法，之后argv可能被方法修改
+}
+
+// 设置请求的上下文，超时取连接的超时时间和客户端传递的超时时间中较小的一个，
+// 从读取到header时开始计算，在工作池或者许可上排队的时间也计算在内
+func (req *request) initContext(timeout time.Duration) {
+	if req.timeout > 0 && (timeout == 0 || req.timeout < timeout) {
+		timeout = req.timeout
+	}
+	if req.timeout = timeout; timeout > 0 {
+		req.ctx, req.cancel = context.WithDeadline(req.ctx, req.start.Add(timeout))
+		return
+	}
+	req.ctx, req.cancel = context.WithCancel(req.ctx)
+}
+
+// 最近一次读取的body大小，codec不支持统计时返回0
+func readSize(c codec.Codec) int {
+	if sizer, ok := c.(codec.Sizer); ok {
+		return sizer.ReadSize()
+	}
+	return 0
 }
 
 // 解析header
@@ -152,7 +380,7 @@ func (server *Server) readRequestHeader(c codec.Codec) (*codec.Header, error) {
 	var h codec.Header
 	if err := c.ReadHeader(&h); err != nil {
 		if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
-			log.Println("rpc server readRequestHeader: ", err)
+			server.logger.Warn("rpc server: read header error", logger.Err(err))
 		}
 		return nil, err
 	}
@@ -160,16 +388,28 @@ func (server *Server) readRequestHeader(c codec.Codec) (*codec.Header, error) {
 }
 
 // 解析request, 返回nil表示解析header失败
-func (server *Server) readRequest(c codec.Codec) (*request, error) {
+func (server *Server) readRequest(ctx context.Context, c codec.Codec, remoteAddr string) (*request, error) {
 	header, err := server.readRequestHeader(c)
 	if err != nil {
 		return nil, err
 	}
 	req := &request{
-		h: header,
+		h:          header,
+		ctx:        codec.NewIncomingContext(ctx, header.Metadata),
+		timeout:    header.Timeout,
+		remoteAddr: remoteAddr,
+		start:      time.Now(),
+		sampled:    server.accessLog.sample(),
+	}
+	header.Metadata, header.Timeout = nil, 0 // 响应复用该header，元数据和超时时间不需要回传
+	if header.Control != codec.ControlNone { // 控制消息没有对应的方法，丢弃空的body帧
+		_ = c.ReadBody(nil)
+		return req, nil
 	}
 	req.service, req.mType, err = server.findService(header.ServiceMethod)
 	if err != nil {
+		_ = c.ReadBody(nil) // 丢弃body帧，保证后续请求可以正常读取
+		req.reqSize = readSize(c)
 		return req, err
 	}
 	req.argv = req.mType.NewArgv()
@@ -179,49 +419,116 @@ func (server *Server) readRequest(c codec.Codec) (*request, error) {
 	if req.argv.Type().Kind() != reflect.Pointer {
 		argvI = req.argv.Addr().Interface()
 	}
-	if err = c.ReadBody(argvI); err != nil {
-		log.Println("rpc server -> read argv ")
+	err = c.ReadBody(argvI)
+	req.reqSize = readSize(c)
+	if err != nil {
+		server.logger.Warn("rpc server: read argv error", logger.ServiceMethod(header.ServiceMethod), logger.Seq(header.Seq), logger.Err(err))
+		return req, codec.Errorf(codec.CodeInvalidArgument, "rpc server: read argv error: %v", err)
 	}
 	return req, nil
 }
 
-// 输出服务端响应
-func (server *Server) sendResponse(c codec.Codec, h *codec.Header, r any, sending *sync.Mutex) {
+// 输出服务端响应，返回写入的body大小，codec不支持统计时返回0
+func (server *Server) sendResponse(c codec.Codec, h *codec.Header, r any, sending *sync.Mutex) int {
 	sending.Lock()
 	defer sending.Unlock()
 	if err := c.Write(h, r); err != nil { // 加锁依次输出响应
-		log.Println("rpc server: write response error: ", err)
+		server.logger.Warn("rpc server: write response error", logger.ServiceMethod(h.ServiceMethod), logger.Seq(h.Seq), logger.Err(err))
+		if errors.Is(err, codec.ErrEncodeBody) { // reply无法序列化，连接仍然可用，需要告知客户端
+			setError(h, codec.NewStatus(codec.CodeInternal, err.Error()))
+			_ = c.Write(h, invalidRequest)
+		}
+	}
+	if sizer, ok := c.(codec.Sizer); ok {
+		return sizer.WriteSize()
 	}
+	return 0
 }
 
-func (server *Server) handleRequest(f codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
-	log.Println("rpc server, handler request: ", req.h, req.argv)
+// 拒绝还没有获取许可的请求
+func (server *Server) rejectRequest(f codec.Codec, req *request, err error, sending *sync.Mutex) {
+	atomic.AddInt64(&server.active, -1)
+	setError(req.h, err)
+	req.respSize = server.sendResponse(f, req.h, invalidRequest, sending)
+	server.record(req)
+}
+
+// 请求在方法返回之前结束：超时时返回超时错误，客户端取消或者连接关闭时只记录，等待许可时服务端开始关闭则返回错误
+func (server *Server) abortRequest(f codec.Codec, req *request, sending *sync.Mutex) {
+	switch err := req.ctx.Err(); {
+	case err == nil:
+		setError(req.h, ErrServerShutdown)
+		req.respSize = server.sendResponse(f, req.h, invalidRequest, sending)
+	case errors.Is(err, context.DeadlineExceeded):
+		server.logger.Warn("rpc server: handler timeout", logger.ServiceMethod(req.h.ServiceMethod), logger.Seq(req.h.Seq),
+			logger.RemoteAddr(req.remoteAddr), logger.F("timeout", req.timeout))
+		setError(req.h, ErrDeadlineExceeded)
+		req.respSize = server.sendResponse(f, req.h, invalidRequest, sending)
+	default: // 客户端已经不再等待该响应
+		req.h.Code = codec.CodeCanceled // 不会发送响应，只用于记录
+	}
+	server.record(req)
+}
+
+func (server *Server) handleRequest(f codec.Codec, req *request, sending *sync.Mutex) {
+	// 排队期间已经超时或者被客户端取消，不再调用方法
+	if req.ctx.Err() != nil {
+		server.abortRequest(f, req, sending)
+		return
+	}
+	// 处理超时或者连接关闭时取消ctx，声明了context.Context的方法可以感知到
+	ctx := req.ctx
+	if req.sampled { // 在处理请求的goroutine中序列化参数，不占用连接的读取循环
+		req.args = server.accessLog.requestArgs(req.argv)
+	}
+	req.invoked = true
+	called := make(chan error, 1) // 带缓冲，超时返回后方法执行完毕也不会阻塞
+	server.logger.Debug("rpc server: handle request", logger.ServiceMethod(req.h.ServiceMethod), logger.Seq(req.h.Seq), logger.RemoteAddr(req.remoteAddr))
 	go func() {
-		err := req.service.Call(req.mType, req.argv, req.reply) // 真正调用service中的method方法
-		called <- struct{}{}
+		defer func() { // 方法或者拦截器panic时只影响当前请求，转换为错误响应
+			if r := recover(); r != nil {
+				atomic.AddUint64(&req.mType.NumPanics, 1)
+				server.logger.Error("rpc server: handler panic", logger.ServiceMethod(req.h.ServiceMethod), logger.Seq(req.h.Seq),
+					logger.RemoteAddr(req.remoteAddr), logger.F("panic", r), logger.F("stack", stackExcerpt()))
+				called <- codec.Errorf(codec.CodeInternal, "rpc server: %s panic: %v", req.h.ServiceMethod, r)
+			}
+		}()
+		called <- server.invoke(ctx, req) // 经过拦截器后真正调用service中的method方法
+	}()
+	select {
+	case <-ctx.Done(): // 如果先于called执行，说明超时、客户端取消或者连接已关闭
+		// 先返回响应，但要等方法真正返回后才释放worker和并发数的许可，保证限制的是实际执行的方法数
+		defer func() { <-called }()
+		server.abortRequest(f, req, sending)
+	case err := <-called:
 		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(f, req.h, invalidRequest, sending)
-			return
+			setError(req.h, err)
+			req.respSize = server.sendResponse(f, req.h, invalidRequest, sending)
+		} else {
+			req.respSize = server.sendResponse(f, req.h, req.reply.Interface(), sending)
 		}
-		server.sendResponse(f, req.h, req.reply.Interface(), sending)
-		sent <- struct{}{}
-	}()
-	if timeout == 0 {
-		<-called
-		<-sent
-		return
+		server.record(req)
 	}
-	select {
-	case <-time.After(timeout): // 如果先于called执行，说明called超时，那么直接调用响应返回
-		req.h.Error = fmt.Sprintf("rpc server: request handler timeout: expect within %s", timeout)
-		server.sendResponse(f, req.h, invalidRequest, sending)
-	case <-called: // 如果先于time.After执行，说明called没有超时，那么等待sent执行完毕
-		<-sent
+}
+
+// 请求结束时记录指标、访问日志和调试日志，req.h.Code为请求的结果
+func (server *Server) record(req *request) {
+	latency := time.Since(req.start)
+	server.metrics.observe(req.method(), req.h.Code, latency)
+	server.accessLog.write(req, latency)
+	server.logger.Debug("rpc server: request handled", logger.ServiceMethod(req.h.ServiceMethod), logger.Seq(req.h.Seq),
+		logger.RemoteAddr(req.remoteAddr), logger.Latency(latency), logger.F("code", req.h.Code))
+}
+
+const maxStackLines = 20 // panic时日志中保留的堆栈行数
+
+// 截取panic时的堆栈，避免日志过长
+func stackExcerpt() string {
+	lines := strings.SplitN(string(debug.Stack()), "\n", maxStackLines+1)
+	if len(lines) > maxStackLines {
+		lines[maxStackLines] = "..."
 	}
+	return strings.Join(lines, "\n")
 }
 
 const (
@@ -238,9 +545,15 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
-		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		server.logger.Warn("rpc server: hijacking error", logger.RemoteAddr(req.RemoteAddr), logger.Err(err))
 		return
 	}
 	_, _ = io.WriteString(conn, "HTTP/1.0 "+Connected+"\n\n")
 	server.ServerConn(conn)
 }
+
+// setError 将错误转换为错误码、错误信息和详情写入响应header，非Status错误的错误码为CodeUnknown
+func setError(h *codec.Header, err error) {
+	st := codec.StatusFromError(err)
+	h.Code, h.Error, h.Details = st.Code, st.Message, st.Details
+}
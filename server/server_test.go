@@ -0,0 +1,847 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"go-rpc/codec"
+	"go-rpc/logger"
+	"go-rpc/metrics"
+	"go-rpc/service"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 建立连接并完成握手，返回客户端使用的codec
+func dialPipe(t *testing.T, s *Server) codec.Codec {
+	c1, c2 := net.Pipe()
+	go s.ServerConn(c2)
+	opt := *DefaultOption
+	if err := WriteHandshake(c1, &Handshake{Version: ProtocolVersion, Option: opt}); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := ReadAck(c1); err != nil || ack.Status != AckOK {
+		t.Fatalf("handshake failed: %v, %+v", err, ack)
+	}
+	return codec.NewCodecFuncMap[opt.CodecType](c1)
+}
+
+func TestRequestDeadline(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	h := &codec.Header{ServiceMethod: "Foo.Sleep", Seq: 1, Timeout: 50 * time.Millisecond}
+	if err := c.Write(h, service.Args{Num1: 5}); err != nil {
+		t.Fatal(err)
+	}
+	var resp codec.Header
+	if err := c.ReadHeader(&resp); err != nil || resp.Error != ErrDeadlineExceeded.Error() || resp.Code != codec.CodeDeadlineExceeded {
+		t.Errorf("expect deadline exceeded, got %v, %+v", err, resp)
+	}
+	_ = c.ReadBody(nil)
+}
+
+func TestInterceptor(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	var order []string
+	s.Use(func(ctx context.Context, info *CallInfo, argv, reply any, handler Handler) error {
+		order = append(order, "first")
+		if info.Metadata.Get("token") == "" {
+			return errors.New("unauthorized")
+		}
+		return handler(ctx, argv, reply)
+	}, func(ctx context.Context, info *CallInfo, argv, reply any, handler Handler) error {
+		order = append(order, "second")
+		return handler(ctx, argv, reply)
+	})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	var resp codec.Header
+	var reply int
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, service.Args{Num1: 1, Num2: 2})
+	if _ = c.ReadHeader(&resp); resp.Error != "unauthorized" {
+		t.Errorf("expect unauthorized, got %+v", resp)
+	}
+	_ = c.ReadBody(nil)
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2, Metadata: codec.Metadata{"token": "t"}}, service.Args{Num1: 1, Num2: 2})
+	if _ = c.ReadHeader(&resp); resp.Error != "" || c.ReadBody(&reply) != nil || reply != 3 {
+		t.Errorf("expect 3, got %+v, %d", resp, reply)
+	}
+	if strings.Join(order, ",") != "first,first,second" {
+		t.Errorf("unexpected interceptor order: %v", order)
+	}
+}
+
+type Panic int
+
+func (p Panic) Boom(args int, reply *int) error {
+	panic("boom")
+}
+
+func TestHandlerPanic(t *testing.T) {
+	s := NewServer()
+	var p Panic
+	var foo service.Foo
+	_ = s.Register(&p)
+	_ = s.Register(&foo)
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	var resp codec.Header
+	var reply int
+	_ = c.Write(&codec.Header{ServiceMethod: "Panic.Boom", Seq: 1}, 1)
+	if _ = c.ReadHeader(&resp); !strings.Contains(resp.Error, "panic: boom") || resp.Code != codec.CodeInternal {
+		t.Errorf("expect panic error, got %+v", resp)
+	}
+	_ = c.ReadBody(nil)
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, service.Args{Num1: 1, Num2: 2})
+	if _ = c.ReadHeader(&resp); resp.Error != "" || c.ReadBody(&reply) != nil || reply != 3 {
+		t.Errorf("server should keep serving after panic, got %+v", resp)
+	}
+	svc, _ := s.serviceMap.Load("Panic")
+	if n := svc.(*Service).Method["Boom"].NumPanics; n != 1 {
+		t.Errorf("expect 1 panic counted, got %d", n)
+	}
+}
+
+// Slow 不感知ctx取消的方法
+type Slow int
+
+func (s Slow) Wait(args int, reply *int) error {
+	time.Sleep(time.Duration(args) * time.Millisecond)
+	return nil
+}
+
+func TestTimeoutHoldsWorker(t *testing.T) {
+	s := NewServer()
+	var slow Slow
+	var foo service.Foo
+	_ = s.Register(&slow)
+	_ = s.Register(&foo)
+	s.SetWorkerPool(PoolOption{Size: 1, QueueLen: 1})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	start := time.Now()
+	var resp codec.Header
+	_ = c.Write(&codec.Header{ServiceMethod: "Slow.Wait", Seq: 1, Timeout: 20 * time.Millisecond}, 300)
+	if _ = c.ReadHeader(&resp); resp.Code != codec.CodeDeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %+v", resp)
+	}
+	_ = c.ReadBody(nil)
+	// 超时的方法仍在执行，worker不能被后续请求使用
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, service.Args{Num1: 1, Num2: 2})
+	if _ = c.ReadHeader(&resp); resp.Seq != 2 || time.Since(start) < 300*time.Millisecond {
+		t.Errorf("expect Foo.Sum wait for Slow.Wait to return, got %+v after %s", resp, time.Since(start))
+	}
+	_ = c.ReadBody(nil)
+}
+
+func TestTimeoutHoldsRequestLimit(t *testing.T) {
+	s := NewServer()
+	var slow Slow
+	var foo service.Foo
+	_ = s.Register(&slow)
+	_ = s.Register(&foo)
+	s.SetLimits(Limits{MaxRequests: 1, Policy: RejectOnLimit})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	var resp codec.Header
+	_ = c.Write(&codec.Header{ServiceMethod: "Slow.Wait", Seq: 1, Timeout: 20 * time.Millisecond}, 300)
+	if _ = c.ReadHeader(&resp); resp.Code != codec.CodeDeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %+v", resp)
+	}
+	_ = c.ReadBody(nil)
+	// 超时的方法返回之前仍然占用并发数
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, service.Args{Num1: 1, Num2: 2})
+	if _ = c.ReadHeader(&resp); resp.Error != ErrServerBusy.Error() {
+		t.Errorf("expect server busy while Slow.Wait is running, got %+v", resp)
+	}
+	_ = c.ReadBody(nil)
+}
+
+func TestCancelWhileQueued(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	s.SetLimits(Limits{MaxConnRequests: 1})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	// 等待许可时连接仍然读取取消消息
+	start := time.Now()
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sleep", Seq: 1}, service.Args{Num1: 3})
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, service.Args{Num1: 1, Num2: 2})
+	_ = c.Write(&codec.Header{Seq: 1, Control: codec.ControlCancel}, nil)
+	var resp codec.Header
+	var reply int
+	if err := c.ReadHeader(&resp); err != nil || resp.Seq != 2 || c.ReadBody(&reply) != nil || reply != 3 {
+		t.Fatalf("expect Foo.Sum answered, got %v, %+v", err, resp)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expect Foo.Sleep canceled, Foo.Sum answered after %s", time.Since(start))
+	}
+}
+
+func TestQueuedRequestsBounded(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	s.SetLimits(Limits{MaxRequests: 1, MaxQueuedRequests: 4, MaxConnQueuedRequests: 2})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	// 一个请求在执行，两个请求等待许可，超出连接排队上限的请求直接返回繁忙，不会各自占用一个goroutine
+	const n = 200
+	base := runtime.NumGoroutine()
+	go func() {
+		for i := 1; i <= n; i++ {
+			_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sleep", Seq: uint64(i)}, service.Args{Num1: 1})
+		}
+	}()
+	var resp codec.Header
+	for i := 0; i < n-3; i++ {
+		if _ = c.ReadHeader(&resp); resp.Error != ErrServerBusy.Error() {
+			t.Fatalf("expect server busy, got %+v", resp)
+		}
+		_ = c.ReadBody(nil)
+	}
+	if grown := runtime.NumGoroutine() - base; grown > 10 {
+		t.Errorf("expect queued requests bounded, goroutines grew by %d", grown)
+	}
+	if queued := len(s.queueSem); queued != 2 {
+		t.Errorf("expect 2 requests waiting for permits, got %d", queued)
+	}
+}
+
+func TestConnLimitDoesNotHoldWorkers(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	s.SetWorkerPool(PoolOption{Size: 2})
+	s.SetLimits(Limits{MaxConnRequests: 1})
+	a, b := dialPipe(t, s), dialPipe(t, s)
+	defer func() { _ = a.Close() }()
+	defer func() { _ = b.Close() }()
+
+	// 连接a达到自己的请求数上限，等待许可的请求不能占满worker，连接b的请求不受影响
+	go func() { // 读取连接a的响应，避免发送响应时阻塞
+		var h codec.Header
+		for a.ReadHeader(&h) == nil && a.ReadBody(nil) == nil {
+		}
+	}()
+	for i := 1; i <= 3; i++ {
+		_ = a.Write(&codec.Header{ServiceMethod: "Foo.Sleep", Seq: uint64(i)}, service.Args{Num1: 1})
+	}
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	_ = b.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, service.Args{Num1: 1, Num2: 2})
+	var resp codec.Header
+	if err := b.ReadHeader(&resp); err != nil || resp.Error != "" || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expect Foo.Sum on another connection answered immediately, got %v, %+v after %s", err, resp, time.Since(start))
+	}
+	_ = b.ReadBody(nil)
+}
+
+func TestShutdown(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	accepted := make(chan struct{})
+	go func() {
+		s.Accept(l)
+		close(accepted)
+	}()
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sleep", Seq: 1}, service.Args{Num1: 1, Num2: 2})
+	time.Sleep(100 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	var resp codec.Header
+	var reply int
+	if err := c.ReadHeader(&resp); err != nil || resp.Control != codec.ControlGoAway {
+		t.Fatalf("expect go away, got %v, %+v", err, resp)
+	}
+	_ = c.ReadBody(nil)
+	if err := c.ReadHeader(&resp); err != nil || resp.Seq != 1 || c.ReadBody(&reply) != nil || reply != 2 {
+		t.Fatalf("expect in-flight request finished, got %v, %+v", err, resp)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("shutdown error: %v", err)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Error("Accept should return after shutdown")
+	}
+}
+
+func TestShutdownUnreadConn(t *testing.T) {
+	s := NewServer()
+	c := dialPipe(t, s) // 客户端不读取数据，goAway会一直阻塞
+	defer func() { _ = c.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expect deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Shutdown should return when ctx is done")
+	}
+
+	s = NewServer()
+	c = dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		_ = s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		<-done
+	case <-time.After(time.Second):
+		t.Error("Close should not wait for go away")
+	}
+}
+
+func TestServicePool(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	s.SetWorkerPool(PoolOption{Size: 1})
+	s.SetServicePool("Foo.Sleep", PoolOption{Size: 1})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	// Foo.Sleep的工作池已满时在池内排队，不会阻塞连接读取其他服务的请求
+	for i := 1; i <= 3; i++ {
+		_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sleep", Seq: uint64(i)}, service.Args{Num1: 1})
+	}
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 4}, service.Args{Num1: 1, Num2: 2})
+	start := time.Now()
+	var resp codec.Header
+	if err := c.ReadHeader(&resp); err != nil || resp.Seq != 4 || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Foo.Sum should not wait for Foo.Sleep, got %v, %+v", err, resp)
+	}
+}
+
+func TestQueuedDeadline(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	s.SetWorkerPool(PoolOption{Size: 1})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	// 在工作池中排队的时间也计算在超时时间内，超时后不再调用方法
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sleep", Seq: 1}, service.Args{Num1: 1})
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2, Timeout: 200 * time.Millisecond}, service.Args{Num1: 1, Num2: 2})
+	var resp codec.Header
+	for i := 0; i < 2; i++ {
+		_ = c.ReadHeader(&resp)
+		_ = c.ReadBody(nil)
+	}
+	svc, _ := s.serviceMap.Load("Foo")
+	if resp.Seq != 2 || resp.Code != codec.CodeDeadlineExceeded || atomic.LoadUint64(&svc.(*Service).Method["Sum"].NumCalls) != 0 {
+		t.Errorf("expect Foo.Sum expired in queue without being called, got %+v", resp)
+	}
+}
+
+func TestCancelQueued(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	s.SetWorkerPool(PoolOption{Size: 1})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	// 在工作池中排队时被取消的请求不再调用方法
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sleep", Seq: 1}, service.Args{Num1: 1})
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, service.Args{Num1: 1, Num2: 2})
+	_ = c.Write(&codec.Header{Seq: 2, Control: codec.ControlCancel}, nil)
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 3}, service.Args{Num1: 1, Num2: 2})
+	var resp codec.Header
+	var seqs []uint64
+	for i := 0; i < 2; i++ {
+		_ = c.ReadHeader(&resp)
+		_ = c.ReadBody(nil)
+		seqs = append(seqs, resp.Seq)
+	}
+	svc, _ := s.serviceMap.Load("Foo")
+	if seqs[0] != 1 || seqs[1] != 3 || atomic.LoadUint64(&svc.(*Service).Method["Sum"].NumCalls) != 1 {
+		t.Errorf("expect canceled Foo.Sum not called, got responses %v", seqs)
+	}
+}
+
+func TestWorkerPoolClose(t *testing.T) {
+	p := newWorkerPool(PoolOption{Size: 1, QueueLen: 1})
+	started, block, done := make(chan struct{}), make(chan struct{}), make(chan struct{}, 2)
+	p.submit(func() { close(started); <-block; done <- struct{}{} })
+	<-started
+	p.submit(func() { done <- struct{}{} })
+	if p.submit(func() {}) {
+		t.Error("expect rejected when the worker is busy and queue is full")
+	}
+	p.close()
+	if p.submit(func() {}) {
+		t.Error("expect rejected after close")
+	}
+	close(block)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("queued tasks should run after close")
+		}
+	}
+}
+
+func TestPoolQueueBounded(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	s.SetWorkerPool(PoolOption{Size: 1, QueueLen: 2})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	// 排队模式下工作池的队列同样有上限，超出的请求直接返回繁忙，不会在池内无限堆积
+	const n = 20
+	go func() {
+		for i := 1; i <= n; i++ {
+			_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sleep", Seq: uint64(i)}, service.Args{Num1: 1})
+		}
+	}()
+	var resp codec.Header
+	for i := 0; i < n-3; i++ {
+		if _ = c.ReadHeader(&resp); resp.Error != ErrServerBusy.Error() {
+			t.Fatalf("expect server busy, got %+v", resp)
+		}
+		_ = c.ReadBody(nil)
+	}
+	s.pool.mu.Lock()
+	pending := len(s.pool.pending)
+	s.pool.mu.Unlock()
+	if pending > 3 { // 交给空闲worker的任务还没有被取走时也计算在内
+		t.Errorf("expect at most 3 pending tasks, got %d", pending)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	s.SetRateLimit("Foo.Sum", RateLimit{Rate: 0.01, Burst: 1, PerClient: true, IdentityKey: "user"})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	for i, user := range []string{"a", "a", "b"} {
+		var resp codec.Header
+		_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: uint64(i), Metadata: codec.Metadata{"user": user}}, service.Args{Num1: 1, Num2: 2})
+		_ = c.ReadHeader(&resp)
+		_ = c.ReadBody(nil)
+		if limited := resp.Error == ErrRateLimited.Error(); limited != (i == 1) {
+			t.Errorf("request %d from %s: unexpected response %+v", i, user, resp)
+		}
+	}
+}
+
+func TestRateLimitMaxClients(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	s.SetRateLimit("Foo.Sum", RateLimit{Rate: 0.01, Burst: 1, PerClient: true, IdentityKey: "user", MaxClients: 1})
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	// 令牌桶数量达到上限后，更换标识的客户端共用一个令牌桶
+	for i, user := range []string{"a", "b", "c", "d"} {
+		var resp codec.Header
+		_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: uint64(i), Metadata: codec.Metadata{"user": user}}, service.Args{Num1: 1, Num2: 2})
+		_ = c.ReadHeader(&resp)
+		_ = c.ReadBody(nil)
+		if limited := resp.Error == ErrRateLimited.Error(); limited != (i > 1) {
+			t.Errorf("request %d from %s: unexpected response %+v", i, user, resp)
+		}
+	}
+	if n := len(s.rateLimiters["Foo.Sum"].buckets); n != 2 {
+		t.Errorf("expect 2 buckets, got %d", n)
+	}
+}
+
+func TestRateLimitReconnect(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	s.SetRateLimit("Foo.Sum", RateLimit{Rate: 0.01, Burst: 1, PerClient: true})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+
+	// 每次重新建立连接，端口不同但仍然按照同一个客户端限流
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = WriteHandshake(conn, &Handshake{Version: ProtocolVersion, Option: *DefaultOption})
+		if ack, err := ReadAck(conn); err != nil || ack.Status != AckOK {
+			t.Fatalf("handshake failed: %v, %+v", err, ack)
+		}
+		c := codec.NewCodecFuncMap[DefaultOption.CodecType](conn)
+		var resp codec.Header
+		_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, service.Args{Num1: 1, Num2: 2})
+		_ = c.ReadHeader(&resp)
+		_ = c.ReadBody(nil)
+		if limited := resp.Error == ErrRateLimited.Error(); limited != (i > 0) {
+			t.Errorf("call %d: unexpected response %+v", i, resp)
+		}
+		_ = c.Close()
+	}
+}
+
+func TestReflection(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	var resp codec.Header
+	var services []ServiceInfo
+	_ = c.Write(&codec.Header{ServiceMethod: "Reflection.ListServices", Seq: 1}, []string{"Foo"})
+	if err := c.ReadHeader(&resp); err != nil || resp.Error != "" || c.ReadBody(&services) != nil {
+		t.Fatalf("list services failed: %v, %+v", err, resp)
+	}
+	if len(services) != 1 || services[0].Name != "Foo" || len(services[0].Methods) != 2 {
+		t.Fatalf("unexpected services: %+v", services)
+	}
+	sum, sleep := services[0].Methods[1], services[0].Methods[0]
+	if sum.Name != "Sum" || sum.ArgType.Name != "service.Args" || sum.ReplyType.Name != "*int" ||
+		len(sum.ArgType.Fields) != 2 || sum.ArgType.Fields[0].Name != "Num1" || sum.WithContext || !sleep.WithContext {
+		t.Errorf("unexpected method description: %+v, %+v", sum, sleep)
+	}
+
+	var info ServiceInfo
+	_ = c.Write(&codec.Header{ServiceMethod: "Reflection.DescribeService", Seq: 2}, "Missing")
+	if _ = c.ReadHeader(&resp); resp.Code != codec.CodeNotFound {
+		t.Errorf("expect not found, got %+v", resp)
+	}
+	_ = c.ReadBody(nil)
+	_ = c.Write(&codec.Header{ServiceMethod: "Reflection.DescribeService", Seq: 3}, "Reflection")
+	if _ = c.ReadHeader(&resp); resp.Error != "" || c.ReadBody(&info) != nil || info.Name != "Reflection" {
+		t.Errorf("expect reflection service described, got %+v, %+v", resp, info)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	var resp codec.Header
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, service.Args{Num1: 1, Num2: 2})
+	_ = c.ReadHeader(&resp)
+	_ = c.ReadBody(nil)
+
+	w := httptest.NewRecorder()
+	s.DebugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, DefaultDebugPath, nil))
+	body := w.Body.String()
+	for _, want := range []string{"Service Foo", "Sum(service.Args, *int) error", "<td align=center>1</td>", "Service Reflection"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expect debug page contains %q, got %s", want, body)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := NewServer()
+	var foo service.Foo
+	_ = s.Register(&foo)
+	r := metrics.NewRegistry()
+	s.SetMetrics(r)
+	c := dialPipe(t, s)
+
+	var resp codec.Header
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, service.Args{Num1: 1, Num2: 2})
+	_ = c.ReadHeader(&resp)
+	_ = c.ReadBody(nil)
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Missing", Seq: 2}, service.Args{})
+	_ = c.ReadHeader(&resp)
+	_ = c.ReadBody(nil)
+	time.Sleep(50 * time.Millisecond) // 指标在响应发送之后记录
+
+	if v := r.Gauge("go_rpc_server_connections", "").With().Value(); v != 1 {
+		t.Errorf("expect 1 open connection, got %v", v)
+	}
+	if v := r.Counter("go_rpc_server_requests_total", "", "method").With("Foo.Sum").Value(); v != 1 {
+		t.Errorf("expect 1 Foo.Sum request, got %v", v)
+	}
+	if v := r.Counter("go_rpc_server_errors_total", "", "method", "code").With(unknownMethod, "NotFound").Value(); v != 1 {
+		t.Errorf("expect 1 not found error, got %v", v)
+	}
+	if n := r.Histogram("go_rpc_server_request_duration_seconds", "", nil, "method").With("Foo.Sum").Count(); n != 1 {
+		t.Errorf("expect 1 latency observation, got %d", n)
+	}
+	if v := r.Gauge("go_rpc_server_in_flight_requests", "", "method").With("Foo.Sum").Value(); v != 0 {
+		t.Errorf("expect no in-flight request, got %v", v)
+	}
+	_ = c.Close()
+	time.Sleep(50 * time.Millisecond)
+	if v := r.Gauge("go_rpc_server_connections", "").With().Value(); v != 0 {
+		t.Errorf("expect connection closed, got %v", v)
+	}
+}
+
+// 并发安全的bytes.Buffer，连接关闭时服务端仍可能输出日志
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogger(t *testing.T) {
+	var buf syncBuffer
+	s := NewServer()
+	s.SetLogger(logger.New(&buf, logger.DebugLevel))
+	var foo service.Foo
+	_ = s.Register(&foo)
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	var resp codec.Header
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 7}, service.Args{Num1: 1, Num2: 2})
+	_ = c.ReadHeader(&resp)
+	_ = c.ReadBody(nil)
+	time.Sleep(50 * time.Millisecond) // 日志在响应发送之后输出
+
+	out := buf.String()
+	for _, want := range []string{"INFO rpc server: register service_method=Foo.Sum", "DEBUG rpc server: request handled service_method=Foo.Sum seq=7", "latency="} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expect log contains %q, got %s", want, out)
+		}
+	}
+	if strings.Contains(out, "Num1") {
+		t.Errorf("request arguments should not be logged: %s", out)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf syncBuffer
+	s := NewServer()
+	s.SetAccessLog(AccessLog{Writer: &buf, LogArgs: true, RedactFields: []string{"num2"}})
+	var foo service.Foo
+	_ = s.Register(&foo)
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	var resp codec.Header
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, service.Args{Num1: 1, Num2: 2})
+	_ = c.ReadHeader(&resp)
+	_ = c.ReadBody(nil)
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Missing", Seq: 2}, service.Args{})
+	_ = c.ReadHeader(&resp)
+	_ = c.ReadBody(nil)
+	time.Sleep(50 * time.Millisecond) // 访问日志在响应发送之后输出
+
+	var records []accessRecord
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r accessRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid access log line %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expect 2 records, got %d", len(records))
+	}
+	sum, missing := records[0], records[1]
+	if sum.ServiceMethod != "Foo.Sum" || sum.Seq != 1 || sum.Code != "OK" || sum.RequestSize == 0 || sum.ResponseSize == 0 ||
+		string(sum.Args) != `{"Num1":1,"Num2":"***"}` {
+		t.Errorf("unexpected record: %+v, args %s", sum, sum.Args)
+	}
+	if missing.Code != "NotFound" || missing.Error == "" {
+		t.Errorf("unexpected error record: %+v", missing)
+	}
+}
+
+func TestAccessLogRemoteAddr(t *testing.T) {
+	var buf syncBuffer
+	s := NewServer()
+	s.SetAccessLog(AccessLog{Writer: &buf})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = WriteHandshake(conn, &Handshake{Version: ProtocolVersion, Option: *DefaultOption})
+	if ack, err := ReadAck(conn); err != nil || ack.Status != AckOK {
+		t.Fatalf("handshake failed: %v, %+v", err, ack)
+	}
+	c := codec.NewCodecFuncMap[DefaultOption.CodecType](conn)
+	defer func() { _ = c.Close() }()
+
+	// 被拒绝的请求也要记录客户端地址
+	var resp codec.Header
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Missing", Seq: 1}, nil)
+	_ = c.ReadHeader(&resp)
+	_ = c.ReadBody(nil)
+	time.Sleep(50 * time.Millisecond) // 访问日志在响应发送之后输出
+
+	var r accessRecord
+	if err := json.Unmarshal(bytes.TrimSpace([]byte(buf.String())), &r); err != nil {
+		t.Fatalf("invalid access log %q: %v", buf.String(), err)
+	}
+	if r.Code != "NotFound" || r.RemoteAddr != conn.LocalAddr().String() {
+		t.Errorf("expect remote_addr %s on error record, got %+v", conn.LocalAddr(), r)
+	}
+}
+
+// Mutate 修改参数的方法
+type Mutate int
+
+func (m Mutate) Inc(args *service.Args, reply *int) error {
+	time.Sleep(50 * time.Millisecond)
+	args.Num1++
+	*reply = args.Num1
+	return nil
+}
+
+func TestAccessLogArgsOnTimeout(t *testing.T) {
+	var buf syncBuffer
+	s := NewServer()
+	s.SetAccessLog(AccessLog{Writer: &buf, LogArgs: true})
+	var m Mutate
+	_ = s.Register(&m)
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	// 超时后方法仍在修改参数，访问日志记录的是调用之前的参数
+	var resp codec.Header
+	_ = c.Write(&codec.Header{ServiceMethod: "Mutate.Inc", Seq: 1, Timeout: 10 * time.Millisecond}, service.Args{Num1: 1, Num2: 2})
+	_ = c.ReadHeader(&resp)
+	_ = c.ReadBody(nil)
+	time.Sleep(100 * time.Millisecond)
+
+	var r accessRecord
+	if err := json.Unmarshal(bytes.TrimSpace([]byte(buf.String())), &r); err != nil {
+		t.Fatalf("invalid access log %q: %v", buf.String(), err)
+	}
+	if r.Code != "DeadlineExceeded" || string(r.Args) != `{"Num1":1,"Num2":2}` {
+		t.Errorf("unexpected record: %+v, args %s", r, r.Args)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var buf syncBuffer
+	s := NewServer()
+	s.SetAccessLog(AccessLog{Writer: &buf, SampleRate: 1e-9})
+	var foo service.Foo
+	_ = s.Register(&foo)
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	var resp codec.Header
+	for i := 1; i <= 20; i++ {
+		_ = c.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: uint64(i)}, service.Args{Num1: i})
+		_ = c.ReadHeader(&resp)
+		_ = c.ReadBody(nil)
+	}
+	_ = c.Write(&codec.Header{ServiceMethod: "Foo.Missing", Seq: 21}, service.Args{})
+	_ = c.ReadHeader(&resp)
+	_ = c.ReadBody(nil)
+	time.Sleep(50 * time.Millisecond)
+
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 1 || !strings.Contains(lines[0], "Foo.Missing") {
+		t.Errorf("expect only the error record, got %v", lines)
+	}
+}
+
+// Counted 统计序列化次数的参数
+type Counted int
+
+var countedMarshals int64
+
+func (c Counted) MarshalJSON() ([]byte, error) {
+	atomic.AddInt64(&countedMarshals, 1)
+	return json.Marshal(int(c))
+}
+
+func (c *Counted) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, (*int)(c))
+}
+
+// Echo 使用Counted作为参数的服务
+type Echo int
+
+func (e Echo) Call(args Counted, reply *int) error {
+	*reply = int(args)
+	return nil
+}
+
+func TestAccessLogArgsSkippedWhenNotSampled(t *testing.T) {
+	var buf syncBuffer
+	s := NewServer()
+	s.SetAccessLog(AccessLog{Writer: &buf, SampleRate: 1e-9, LogArgs: true})
+	var e Echo
+	_ = s.Register(&e)
+	c := dialPipe(t, s)
+	defer func() { _ = c.Close() }()
+
+	// 没有被采样的成功请求不序列化参数
+	var resp codec.Header
+	for i := 1; i <= 20; i++ {
+		_ = c.Write(&codec.Header{ServiceMethod: "Echo.Call", Seq: uint64(i)}, i)
+		_ = c.ReadHeader(&resp)
+		_ = c.ReadBody(nil)
+	}
+	if n := atomic.LoadInt64(&countedMarshals); n != 0 {
+		t.Errorf("expect args of unsampled requests not serialized, got %d marshals", n)
+	}
+}
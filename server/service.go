@@ -1,18 +1,25 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
-	"log"
 	"reflect"
 	"sync/atomic"
+	"time"
 )
 
 // 通过反射创建service及其中的方法用于客户端调用执行
 type methodType struct {
-	method    reflect.Method // 调用方法
-	ArgType   reflect.Type   // 请求参数类型
-	ReplyType reflect.Type   // 返回类型，会传入指针类型
-	NumCalls  uint64         // 方法被调用次数
+	method      reflect.Method // 调用方法
+	ArgType     reflect.Type   // 请求参数类型
+	ReplyType   reflect.Type   // 返回类型，会传入指针类型
+	NumCalls    uint64         // 方法被调用次数
+	NumPanics   uint64         // 方法panic的次数
+	NumErrors   uint64         // 方法返回错误的次数
+	NumDone     uint64         // 方法已经返回的次数，计算平均耗时时不包括正在执行的调用
+	Latency     uint64         // 已经返回的调用累计耗时，纳秒
+	withContext bool           // 方法的第一个参数是否是context.Context
 }
 
 type Service struct {
@@ -22,6 +29,15 @@ type Service struct {
 	Method map[string]*methodType // 结构体中所有符合条件的方法
 }
 
+// AvgLatency 已经返回的调用的平均耗时
+func (m *methodType) AvgLatency() time.Duration {
+	done := atomic.LoadUint64(&m.NumDone)
+	if done == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadUint64(&m.Latency) / done)
+}
+
 // NewArgv 入参可以是或不是引用类型
 func (m *methodType) NewArgv() reflect.Value {
 	var arg reflect.Value
@@ -45,43 +61,62 @@ func (m *methodType) NewReply() reflect.Value {
 	return reply
 }
 
-// NewService 注册service及其中的方法
+// NewService 注册service及其中的方法，类型没有导出时panic，需要返回错误时使用TryNewService
 func NewService(v any) *Service {
+	s, err := TryNewService(v)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// TryNewService 注册service及其中的方法，类型没有导出时返回错误
+func TryNewService(v any) (*Service, error) {
 	s := new(Service)
 	s.self = reflect.ValueOf(v)
 	s.typ = reflect.TypeOf(v)
 	s.name = reflect.Indirect(s.self).Type().Name()
 	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+		return nil, fmt.Errorf("rpc server: %s is not a valid service name", s.name)
 	}
 	s.registerMethods() // 注册service中的方法
-	return s
+	return s, nil
 }
 
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 // 注册service中符合条件的方法
+// 支持 func(T, Args, *Reply) error 和 func(T, context.Context, Args, *Reply) error 两种形式
 func (s *Service) registerMethods() {
 	s.Method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
-		// 过滤service中method入参数不是3（第0个参数是方法本身）,返回数不是1
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		// 过滤service中method入参数不是3或4（第0个参数是方法本身）,返回数不是1
+		if (mType.NumIn() != 3 && mType.NumIn() != 4) || mType.NumOut() != 1 {
 			continue
 		}
 		// 过滤方法返回不是error的
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		if mType.Out(0) != typeOfError {
+			continue
+		}
+		withContext := mType.NumIn() == 4
+		if withContext && mType.In(1) != typeOfContext { // 4个入参时第1个必须是context.Context
 			continue
 		}
-		aType, rType := mType.In(1), mType.In(2)
+		aType, rType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
 		if !isExportedOrBuildInType(aType) || !isExportedOrBuildInType(rType) {
 			continue
 		}
 		s.Method[method.Name] = &methodType{
-			ArgType:   aType,
-			ReplyType: rType,
-			method:    method,
+			ArgType:     aType,
+			ReplyType:   rType,
+			method:      method,
+			withContext: withContext,
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
 
@@ -91,10 +126,25 @@ func isExportedOrBuildInType(t reflect.Type) bool {
 }
 
 func (s *Service) Call(m *methodType, arg, reply reflect.Value) error {
+	return s.CallContext(context.Background(), m, arg, reply)
+}
+
+// CallContext 调用service中的方法，方法声明了context.Context时将ctx传入
+func (s *Service) CallContext(ctx context.Context, m *methodType, arg, reply reflect.Value) error {
 	atomic.AddUint64(&m.NumCalls, 1)
+	start := time.Now()
+	defer func() {
+		atomic.AddUint64(&m.Latency, uint64(time.Since(start)))
+		atomic.AddUint64(&m.NumDone, 1)
+	}()
 	f := m.method.Func
-	result := f.Call([]reflect.Value{s.self, arg, reply}) // 调用service中的方法，第一个参数是方法本身
+	in := []reflect.Value{s.self, arg, reply} // 第一个参数是方法本身
+	if m.withContext {
+		in = []reflect.Value{s.self, reflect.ValueOf(ctx), arg, reply}
+	}
+	result := f.Call(in) // 调用service中的方法
 	if err := result[0].Interface(); err != nil {
+		atomic.AddUint64(&m.NumErrors, 1)
 		return err.(error)
 	}
 	return nil
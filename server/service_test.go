@@ -1,9 +1,12 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"go-rpc/service"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestNewService(t *testing.T) {
@@ -18,3 +21,38 @@ func TestNewService(t *testing.T) {
 		t.Error("failed to call Foo.Sum")
 	}
 }
+
+func TestServiceCallContext(t *testing.T) {
+	var foo service.Foo
+	s := NewService(&foo)
+	mType := s.Method["Sleep"]
+	if mType == nil || !mType.withContext {
+		t.Fatal("failed to register Foo.Sleep with context")
+	}
+	argv := mType.NewArgv()
+	argv.Set(reflect.ValueOf(service.Args{Num1: 10, Num2: 2}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.CallContext(ctx, mType, argv, mType.NewReply()); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect canceled error, got %v", err)
+	}
+}
+
+type unexported int
+
+func TestNewServiceInvalidName(t *testing.T) {
+	var u unexported
+	if _, err := TryNewService(&u); err == nil {
+		t.Error("expect unexported service rejected")
+	}
+	if err := NewServer().Register(&u); err == nil {
+		t.Error("expect Register return error")
+	}
+}
+
+func TestAvgLatency(t *testing.T) {
+	m := &methodType{NumCalls: 2, NumDone: 1, Latency: uint64(100 * time.Millisecond)}
+	if avg := m.AvgLatency(); avg != 100*time.Millisecond { // 正在执行的调用不计入平均耗时
+		t.Errorf("expect average over finished calls, got %s", avg)
+	}
+}
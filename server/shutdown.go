@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"go-rpc/codec"
+	"go-rpc/logger"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerShutdown 服务端正在关闭，不再处理新的请求
+var ErrServerShutdown error = codec.NewStatus(codec.CodeUnavailable, "rpc server: server is shutting down")
+
+const (
+	shutdownPollInterval = 10 * time.Millisecond // 等待请求处理完成时的轮询间隔
+	goAwayWriteTimeout   = 5 * time.Second       // 发送goAway的写超时，避免不读取数据的客户端阻塞关闭
+)
+
+// 服务端的一个连接
+type serverConn struct {
+	rwc        io.ReadWriteCloser
+	mu         sync.Mutex  // 保护c
+	c          codec.Codec // 握手完成后才会设置
+	sending    *sync.Mutex // 保证response有序
+	remoteAddr string      // 客户端地址
+}
+
+// 握手成功，先设置codec再输出确认，保证goAway要么直接关闭连接，要么在确认之后发送
+func (sc *serverConn) accept(c codec.Codec, ack *Ack) error {
+	sc.sending.Lock()
+	defer sc.sending.Unlock()
+	sc.mu.Lock()
+	sc.c = c
+	sc.mu.Unlock()
+	return WriteAck(sc.rwc, ack)
+}
+
+// 通知客户端不要再发送新的请求，还没有完成握手的连接直接关闭
+func (sc *serverConn) goAway() error {
+	sc.mu.Lock()
+	c := sc.c
+	sc.mu.Unlock()
+	if c == nil {
+		return sc.rwc.Close()
+	}
+	sc.sending.Lock()
+	defer sc.sending.Unlock()
+	if nc, ok := sc.rwc.(net.Conn); ok {
+		_ = nc.SetWriteDeadline(time.Now().Add(goAwayWriteTimeout))
+		defer func() { _ = nc.SetWriteDeadline(time.Time{}) }()
+	}
+	return c.Write(&codec.Header{Control: codec.ControlGoAway}, nil)
+}
+
+func (server *Server) shuttingDown() bool {
+	select {
+	case <-server.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (server *Server) closeDone() {
+	server.doneOnce.Do(func() {
+		close(server.done)
+	})
+}
+
+// 记录listener，正在关闭时返回false
+func (server *Server) trackListener(l net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, l)
+		return true
+	}
+	if server.shuttingDown() {
+		return false
+	}
+	server.listeners[l] = struct{}{}
+	return true
+}
+
+// 记录连接，正在关闭时返回false
+func (server *Server) trackConn(sc *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.conns, sc)
+		server.metrics.connClosed()
+		return true
+	}
+	if server.shuttingDown() {
+		return false
+	}
+	server.conns[sc] = struct{}{}
+	server.metrics.connOpened()
+	return true
+}
+
+// Shutdown 优雅关闭：停止接收新的连接，通知客户端不再发送新的请求，
+// 等待正在处理的请求完成后关闭所有连接。ctx结束时立即关闭并返回ctx.Err()
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.closeDone()
+	defer server.closePools()
+	server.mu.Lock()
+	server.closeListenersLocked()
+	conns := make([]*serverConn, 0, len(server.conns))
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	server.mu.Unlock()
+
+	// 在锁外并行发送goAway，个别客户端不读取数据时不会阻塞其他连接和Close
+	var wg sync.WaitGroup
+	for _, sc := range conns {
+		wg.Add(1)
+		go func(sc *serverConn) {
+			defer wg.Done()
+			if err := sc.goAway(); err != nil {
+				server.logger.Warn("rpc server: send go away error", logger.RemoteAddr(sc.remoteAddr), logger.Err(err))
+			}
+		}(sc)
+	}
+	sent := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(sent)
+	}()
+	select {
+	case <-ctx.Done():
+		server.closeConns()
+		return ctx.Err()
+	case <-sent:
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&server.active) > 0 {
+		select {
+		case <-ctx.Done():
+			server.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	server.closeConns()
+	return nil
+}
+
+// Close 立即关闭所有的listener和连接，正在处理的请求通过ctx感知到取消
+func (server *Server) Close() error {
+	server.closeDone()
+	server.mu.Lock()
+	server.closeListenersLocked()
+	server.mu.Unlock()
+	server.closeConns()
+	server.closePools()
+	return nil
+}
+
+func (server *Server) closeListenersLocked() {
+	for l := range server.listeners {
+		_ = l.Close()
+		delete(server.listeners, l)
+	}
+}
+
+func (server *Server) closeConns() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for sc := range server.conns {
+		_ = sc.rwc.Close()
+		delete(server.conns, sc)
+	}
+}
@@ -1,6 +1,9 @@
 package service
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type Foo int
 
@@ -13,8 +16,13 @@ func (f Foo) Sum(args Args, reply *int) error {
 	return nil
 }
 
-func (f Foo) Sleep(args Args, reply *int) error {
-	time.Sleep(time.Second * time.Duration(args.Num1))
+// Sleep 休眠Num1秒，ctx取消时提前返回
+func (f Foo) Sleep(ctx context.Context, args Args, reply *int) error {
+	select {
+	case <-time.After(time.Second * time.Duration(args.Num1)):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	*reply = args.Num1 * args.Num2
 	return nil
 }
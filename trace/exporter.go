@@ -0,0 +1,77 @@
+package trace
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Exporter 导出已经结束的span，需要并发安全
+type Exporter interface {
+	Export(s *Span)
+}
+
+// 丢弃所有span
+type nopExporter struct{}
+
+func (nopExporter) Export(*Span) {}
+
+// MemoryExporter 将span保存在内存中，用于本地测试
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewMemoryExporter MemoryExporter的构造函数
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (e *MemoryExporter) Export(s *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+// Spans 按结束顺序返回已导出的span
+func (e *MemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// Reset 清空已导出的span
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// JSONFileExporter 将span以每行一个JSON对象的形式追加写入文件
+type JSONFileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewJSONFileExporter 打开或者创建path，span追加写入到文件末尾
+func NewJSONFileExporter(path string) (*JSONFileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONFileExporter{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (e *JSONFileExporter) Export(s *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_ = e.enc.Encode(s)
+}
+
+// Close 关闭文件
+func (e *JSONFileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
@@ -0,0 +1,23 @@
+module go-rpc/trace
+
+go 1.19
+
+require (
+	go-rpc/client v0.0.1
+	go-rpc/codec v0.0.1
+	go-rpc/metrics v0.0.1
+	go-rpc/registry v0.0.1
+	go-rpc/server v0.0.1
+	go-rpc/service v0.0.1
+	go-rpc/logger v0.0.1
+)
+
+replace (
+	go-rpc/client => ../client
+	go-rpc/codec => ../codec
+	go-rpc/metrics => ../metrics
+	go-rpc/registry => ../registry
+	go-rpc/server => ../server
+	go-rpc/service => ../service
+	go-rpc/logger => ../logger
+)
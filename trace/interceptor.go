@@ -0,0 +1,43 @@
+package trace
+
+import (
+	"context"
+	"go-rpc/client"
+	"go-rpc/codec"
+	"go-rpc/server"
+	"strconv"
+)
+
+// ClientInterceptor 客户端拦截器，为每次调用创建client span，并将追踪信息写入请求元数据。
+// 可以同时注册在LoadBalanceClient和Client上，Client的span会作为LoadBalanceClient的子span
+func ClientInterceptor(t *Tracer) client.Interceptor {
+	return func(ctx context.Context, serviceMethod string, args, reply any, invoker client.Invoker) (err error) {
+		ctx, span := t.Start(ctx, serviceMethod, KindClient)
+		ctx = codec.AppendToOutgoingContext(ctx, TraceIDKey, span.TraceID, SpanIDKey, span.SpanID)
+		defer endSpan(span, &err)
+		return invoker(ctx, serviceMethod, args, reply)
+	}
+}
+
+// ServerInterceptor 服务端拦截器，从请求元数据中继续调用链并创建server span。
+// 方法声明了context.Context时，使用该ctx发起的嵌套调用会成为server span的子span
+func ServerInterceptor(t *Tracer) server.Interceptor {
+	return func(ctx context.Context, info *server.CallInfo, argv, reply any, handler server.Handler) (err error) {
+		ctx, span := t.startFromMetadata(ctx, info.ServiceMethod, info.Metadata)
+		span.SetAttribute("seq", strconv.FormatUint(info.Seq, 10))
+		if info.RemoteAddr != "" {
+			span.SetAttribute("remote_addr", info.RemoteAddr)
+		}
+		defer endSpan(span, &err)
+		return handler(ctx, argv, reply)
+	}
+}
+
+// 调用返回或者panic时结束span，panic记录为内部错误后继续向上传递，交给服务端的panic恢复处理
+func endSpan(span *Span, err *error) {
+	if r := recover(); r != nil {
+		span.End(codec.Errorf(codec.CodeInternal, "panic: %v", r))
+		panic(r)
+	}
+	span.End(*err)
+}
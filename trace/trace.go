@@ -0,0 +1,128 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"go-rpc/codec"
+	"sync"
+	"time"
+)
+
+// 通过请求元数据传递的追踪信息
+const (
+	TraceIDKey = "trace-id" // 整条调用链的ID
+	SpanIDKey  = "span-id"  // 调用方span的ID，作为服务端span的父ID
+)
+
+// SpanKind span的类型
+type SpanKind string
+
+const (
+	KindClient SpanKind = "client" // 客户端发起调用
+	KindServer SpanKind = "server" // 服务端处理请求
+)
+
+// Span 一次调用或者处理过程，结束后交给Exporter导出
+type Span struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"` // 为空表示调用链的起点
+	Name       string            `json:"name"`                // 服务名和方法名
+	Kind       SpanKind          `json:"kind"`
+	Start      time.Time         `json:"start"`
+	Duration   time.Duration     `json:"duration"`
+	Error      string            `json:"error,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// SetAttribute 设置span的属性，End之后设置无效
+func (s *Span) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// End 结束span并导出，err不为nil时记录错误信息，重复调用无效
+func (s *Span) End(err error) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.Duration = time.Since(s.Start)
+	if err != nil {
+		s.Error = err.Error()
+		if s.Attributes == nil {
+			s.Attributes = make(map[string]string)
+		}
+		s.Attributes["code"] = codec.StatusFromError(err).Code.String()
+	}
+	s.mu.Unlock()
+	s.tracer.exporter.Export(s)
+}
+
+// Tracer 创建span并交给exporter导出
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer Tracer的构造函数，exporter为nil时丢弃所有span
+func NewTracer(exporter Exporter) *Tracer {
+	if exporter == nil {
+		exporter = nopExporter{}
+	}
+	return &Tracer{exporter: exporter}
+}
+
+// Start 创建span，ctx中已有span时作为其子span，否则开始新的调用链
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	s := &Span{SpanID: newID(8), Name: name, Kind: kind, Start: time.Now(), tracer: t}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		s.TraceID = newID(16)
+	}
+	return ContextWithSpan(ctx, s), s
+}
+
+// 从调用方传递的元数据继续调用链，没有追踪信息时开始新的调用链
+func (t *Tracer) startFromMetadata(ctx context.Context, name string, md codec.Metadata) (context.Context, *Span) {
+	traceID, parentID := md.Get(TraceIDKey), md.Get(SpanIDKey)
+	if traceID == "" {
+		return t.Start(ctx, name, KindServer)
+	}
+	s := &Span{TraceID: traceID, SpanID: newID(8), ParentID: parentID, Name: name, Kind: KindServer, Start: time.Now(), tracer: t}
+	return ContextWithSpan(ctx, s), s
+}
+
+type spanKey struct{}
+
+// ContextWithSpan 将span附加到ctx上，后续创建的span作为其子span
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext 获取ctx中当前的span，没有时返回nil
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// 生成n字节的随机ID，以十六进制表示
+func newID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,138 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"go-rpc/client"
+	"go-rpc/server"
+	"go-rpc/service"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Chain 通过嵌套调用Foo.Sum完成计算
+type Chain struct {
+	c *client.Client
+}
+
+func (ch *Chain) Sum(ctx context.Context, args service.Args, reply *int) error {
+	return ch.c.Sync(ctx, "Foo.Sum", &args, reply)
+}
+
+func startServer(t *testing.T, tracer *Tracer, svc any) string {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.NewServer()
+	_ = s.Register(svc)
+	s.Use(ServerInterceptor(tracer))
+	go s.Accept(l)
+	t.Cleanup(func() { _ = s.Close() })
+	return l.Addr().String()
+}
+
+func TestPropagation(t *testing.T) {
+	exporter := NewMemoryExporter()
+	tracer := NewTracer(exporter)
+	fooAddr := startServer(t, tracer, new(service.Foo))
+	nested, err := client.Dial("tcp", fooAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = nested.Close() }()
+	nested.Use(ClientInterceptor(tracer))
+	chainAddr := startServer(t, tracer, &Chain{c: nested})
+
+	lb := client.NewLoadBalanceClient(client.NewMultiServerDiscovery([]string{chainAddr}), client.RandomSelect, nil)
+	defer func() { _ = lb.Close() }()
+	lb.Use(ClientInterceptor(tracer))
+	var reply int
+	if err := lb.Call(context.Background(), "Chain.Sum", &service.Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("call Chain.Sum failed: %v", err)
+	}
+
+	// 结束顺序: Foo.Sum server, Foo.Sum client, Chain.Sum server, Chain.Sum client
+	spans := exporter.Spans()
+	if len(spans) != 4 {
+		t.Fatalf("expect 4 spans, got %d", len(spans))
+	}
+	fooServer, fooClient, chainServer, chainClient := spans[0], spans[1], spans[2], spans[3]
+	if chainClient.ParentID != "" || chainClient.Kind != KindClient || chainClient.Name != "Chain.Sum" {
+		t.Errorf("unexpected root span: %+v", chainClient)
+	}
+	for i, pair := range [][2]*Span{{chainServer, chainClient}, {fooClient, chainServer}, {fooServer, fooClient}} {
+		if child, parent := pair[0], pair[1]; child.TraceID != chainClient.TraceID || child.ParentID != parent.SpanID {
+			t.Errorf("span %d not linked to parent: %+v, %+v", i, child, parent)
+		}
+	}
+	if fooServer.Kind != KindServer || fooServer.Attributes["remote_addr"] == "" {
+		t.Errorf("unexpected server span: %+v", fooServer)
+	}
+}
+
+// Panic 总是panic的方法
+type Panic int
+
+func (p Panic) Boom(args int, reply *int) error {
+	panic("boom")
+}
+
+func TestPanicSpan(t *testing.T) {
+	exporter := NewMemoryExporter()
+	tracer := NewTracer(exporter)
+	c, err := client.Dial("tcp", startServer(t, tracer, new(Panic)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	var reply int
+	if err := c.Sync(context.Background(), "Panic.Boom", 1, &reply); err == nil {
+		t.Fatal("expect Panic.Boom failed")
+	}
+	// panic的方法也要导出server span
+	spans := exporter.Spans()
+	if len(spans) != 1 || spans[0].Kind != KindServer || spans[0].Attributes["code"] != "Internal" {
+		t.Errorf("expect server span recording the panic, got %+v", spans)
+	}
+}
+
+func TestNilExporter(t *testing.T) {
+	_, span := NewTracer(nil).Start(context.Background(), "nil", KindClient)
+	span.End(nil) // 不导出也不会panic
+}
+
+func TestJSONFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := NewJSONFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(exporter)
+	ctx, parent := tracer.Start(context.Background(), "parent", KindClient)
+	_, child := tracer.Start(ctx, "child", KindClient)
+	child.End(server.ErrServerBusy)
+	parent.End(nil)
+	_ = exporter.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	var spans []*Span
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s := new(Span)
+		if err := json.Unmarshal(scanner.Bytes(), s); err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, s)
+	}
+	if len(spans) != 2 || spans[0].ParentID != spans[1].SpanID || spans[0].Attributes["code"] != "ServerBusy" {
+		t.Errorf("unexpected exported spans: %+v", spans)
+	}
+}